@@ -94,9 +94,80 @@ func executeCommandWithResult(db KVStore, args []string) (string, error) {
 		err := db.Delete(args[1])
 		return "", err
 
+	case "setnx", "cas", "delifeq":
+		return executeConditional(db, args)
+
+	case "compact":
+		return "", executeCompact(db, args)
+
+	case "stats":
+		return executeStats(db, args)
+
+	default:
+		return "", fmt.Errorf("unknown command '%s'. Available commands: add, search, update, delete, setnx, cas, delifeq, compact, stats", command)
+	}
+}
+
+// Runs a conditional write, the result is "true" if it wrote and "false" if the condition didn't hold
+func executeConditional(db KVStore, args []string) (string, error) {
+	var ok bool
+	var err error
+
+	switch strings.ToLower(args[0]) {
+	case "setnx":
+		if len(args) != 3 {
+			return "", fmt.Errorf("usage: setnx <key> <value>")
+		}
+		ok, err = db.SetIfAbsent(args[1], args[2])
+	case "cas":
+		if len(args) != 4 {
+			return "", fmt.Errorf("usage: cas <key> <old> <new>")
+		}
+		ok, err = db.CompareAndSwap(args[1], args[2], args[3])
+	case "delifeq":
+		if len(args) != 3 {
+			return "", fmt.Errorf("usage: delifeq <key> <value>")
+		}
+		ok, err = db.DeleteIfEquals(args[1], args[2])
 	default:
-		return "", fmt.Errorf("unknown command '%s'. Available commands: add, search, update, delete", command)
+		return "", fmt.Errorf("unknown conditional command '%s'", args[0])
+	}
+
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprint(ok), nil
+}
+
+// Compacts the whole store, the keys from start on or the keys in [start, end)
+func executeCompact(db KVStore, args []string) error {
+	compacter, ok := db.(Compacter)
+	if !ok {
+		return fmt.Errorf("this version doesn't support compaction")
+	}
+
+	switch len(args) {
+	case 1:
+		return compacter.CompactAll()
+	case 2:
+		return compacter.CompactRange(args[1], "")
+	case 3:
+		return compacter.CompactRange(args[1], args[2])
+	default:
+		return fmt.Errorf("usage: compact [start] [end]")
+	}
+}
+
+// Storage stats of the store
+func executeStats(db KVStore, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("usage: stats")
+	}
+	reporter, ok := db.(StatsReporter)
+	if !ok {
+		return "", fmt.Errorf("this version doesn't report stats")
 	}
+	return reporter.Stats(), nil
 }
 
 // printComparisonResults displays the performance comparison in a nice table format
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+
+	"kv-store/kverrors"
+	v1 "kv-store/v1"
+	v2 "kv-store/v2"
+	v3 "kv-store/v3"
+	v4 "kv-store/v4"
+	v4_idx "kv-store/v4_indexed"
+	v5 "kv-store/v5"
+	v6 "kv-store/v6"
+)
+
+// Same versions as dbRegistry, opened at the test's temp dir so the checks never touch the real data
+var conformanceRegistry = map[string]func(dir string) (KVStore, error){
+	"v1": func(dir string) (KVStore, error) { return openStore(v1.Open(dir)) },
+	"v2": func(dir string) (KVStore, error) { return openStore(v2.Open(dir)) },
+	"v3": func(dir string) (KVStore, error) { return openStore(v3.Open(dir)) },
+	"v4": func(dir string) (KVStore, error) { return openStore(v4.Open(dir, v4.Options{})) },
+	"v4_idx": func(dir string) (KVStore, error) { return openStore(v4_idx.Open(dir, v4_idx.Options{})) },
+	"v5": func(dir string) (KVStore, error) { return openStore(v5.Open(dir, v5.Options{})) },
+	"v6": func(dir string) (KVStore, error) { return openStore(v6.Open(dir, v6.Options{Durability: v6.NoSync})) },
+}
+
+// Every check runs on a fresh store
+type conformanceCheck struct {
+	name	string
+	run		func(db KVStore) error
+}
+
+var conformanceChecks = []conformanceCheck{
+	{"missing key is ErrNotFound", func(db KVStore) error {
+		return expectMissing(db, "ghost")
+	}},
+	{"SetIfAbsent on a missing key writes", func(db KVStore) error {
+		if err := expectOK(db.SetIfAbsent("k", "v1")); err != nil {
+			return err
+		}
+		return expectValue(db, "k", "v1")
+	}},
+	{"SetIfAbsent on an existing key doesn't write", func(db KVStore) error {
+		db.Set("k", "v1")
+		if err := expectFailed(db.SetIfAbsent("k", "v2")); err != nil {
+			return err
+		}
+		return expectValue(db, "k", "v1")
+	}},
+	{"SetIfAbsent on a deleted key writes", func(db KVStore) error {
+		db.Set("k", "v1")
+		db.Delete("k")
+		if err := expectOK(db.SetIfAbsent("k", "v2")); err != nil {
+			return err
+		}
+		return expectValue(db, "k", "v2")
+	}},
+	{"CompareAndSwap with the current value swaps", func(db KVStore) error {
+		db.Set("k", "v1")
+		if err := expectOK(db.CompareAndSwap("k", "v1", "v2")); err != nil {
+			return err
+		}
+		return expectValue(db, "k", "v2")
+	}},
+	{"CompareAndSwap with a stale value doesn't swap", func(db KVStore) error {
+		db.Set("k", "v1")
+		if err := expectFailed(db.CompareAndSwap("k", "v0", "v2")); err != nil {
+			return err
+		}
+		return expectValue(db, "k", "v1")
+	}},
+	{"CompareAndSwap on a missing key doesn't write", func(db KVStore) error {
+		if err := expectFailed(db.CompareAndSwap("k", "", "v1")); err != nil {
+			return err
+		}
+		return expectMissing(db, "k")
+	}},
+	{"DeleteIfEquals with the current value deletes", func(db KVStore) error {
+		db.Set("k", "v1")
+		if err := expectOK(db.DeleteIfEquals("k", "v1")); err != nil {
+			return err
+		}
+		return expectMissing(db, "k")
+	}},
+	{"DeleteIfEquals with another value doesn't delete", func(db KVStore) error {
+		db.Set("k", "v1")
+		if err := expectFailed(db.DeleteIfEquals("k", "v2")); err != nil {
+			return err
+		}
+		return expectValue(db, "k", "v1")
+	}},
+	{"DeleteIfEquals on a missing key doesn't write", func(db KVStore) error {
+		return expectFailed(db.DeleteIfEquals("k", "v1"))
+	}},
+	{"concurrent CompareAndSwap increments don't get lost", func(db KVStore) error {
+		const workers, increments = 4, 10
+		db.Set("counter", "0")
+
+		var wg sync.WaitGroup
+		errs := make(chan error, workers)
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < increments; {
+					current, err := db.Get("counter")
+					if err != nil {
+						errs <- err
+						return
+					}
+					n, _ := strconv.Atoi(current)
+					swapped, err := db.CompareAndSwap("counter", current, strconv.Itoa(n+1))
+					if err != nil {
+						errs <- err
+						return
+					}
+					if swapped {
+						i++
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		if err := <-errs; err != nil {
+			return err
+		}
+		return expectValue(db, "counter", strconv.Itoa(workers*increments))
+	}},
+	{"CompareAndSwap to \"null\" stores it as a value", func(db KVStore) error {
+		db.Set("k", "v1")
+		if err := expectOK(db.CompareAndSwap("k", "v1", "null")); err != nil {
+			return err
+		}
+		return expectValue(db, "k", "null")
+	}},
+	{"SetIfAbsent with \"null\" stores it as a value", func(db KVStore) error {
+		if err := expectOK(db.SetIfAbsent("k", "null")); err != nil {
+			return err
+		}
+		return expectValue(db, "k", "null")
+	}},
+	{"closed store returns ErrClosed", func(db KVStore) error {
+		db.Close()
+		if _, err := db.SetIfAbsent("k", "v1"); !errors.Is(err, kverrors.ErrClosed) {
+			return fmt.Errorf("SetIfAbsent: expected ErrClosed, got %v", err)
+		}
+		if _, err := db.CompareAndSwap("k", "v1", "v2"); !errors.Is(err, kverrors.ErrClosed) {
+			return fmt.Errorf("CompareAndSwap: expected ErrClosed, got %v", err)
+		}
+		if _, err := db.DeleteIfEquals("k", "v1"); !errors.Is(err, kverrors.ErrClosed) {
+			return fmt.Errorf("DeleteIfEquals: expected ErrClosed, got %v", err)
+		}
+		return nil
+	}},
+}
+
+func expectOK(ok bool, err error) error {
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("expected the write to happen")
+	}
+	return nil
+}
+
+func expectFailed(ok bool, err error) error {
+	if err != nil {
+		return err
+	}
+	if ok {
+		return fmt.Errorf("expected the condition to fail")
+	}
+	return nil
+}
+
+func expectValue(db KVStore, key, want string) error {
+	got, err := db.Get(key)
+	if err != nil {
+		return fmt.Errorf("get %s: %w", key, err)
+	}
+	if got != want {
+		return fmt.Errorf("get %s: expected %q, got %q", key, want, got)
+	}
+	return nil
+}
+
+func expectMissing(db KVStore, key string) error {
+	if value, err := db.Get(key); !errors.Is(err, kverrors.ErrNotFound) {
+		return fmt.Errorf("get %s: expected ErrNotFound, got %q %v", key, value, err)
+	}
+	return nil
+}
+
+// Runs every check against every version, each on a fresh store
+func TestConformance(t *testing.T) {
+	for version, open := range conformanceRegistry {
+		t.Run(version, func(t *testing.T) {
+			for _, check := range conformanceChecks {
+				t.Run(check.name, func(t *testing.T) {
+					db, err := open(t.TempDir())
+					if err != nil {
+						t.Fatalf("open: %v", err)
+					}
+					defer db.Close()
+
+					if err := check.run(db); err != nil {
+						t.Error(err)
+					}
+				})
+			}
+		})
+	}
+}
@@ -0,0 +1,12 @@
+// Errors shared by every store version, so callers can use errors.Is
+// without caring about which version they opened
+package kverrors
+
+import "errors"
+
+var (
+	ErrNotFound	= errors.New("key not found")
+	ErrCorrupt	= errors.New("data is corrupted")
+	ErrClosed		= errors.New("store is closed")
+	ErrReadOnly	= errors.New("store is read-only")
+)
@@ -22,17 +22,42 @@ type KVStore interface {
 	Update(key, value string) error
 	Delete(key string) error
 	Close() error
+
+	// Conditional writes, the check and the write are atomic. They return false
+	// without writing when the condition doesn't hold. Deleted keys count as missing
+	SetIfAbsent(key, value string) (bool, error)
+	CompareAndSwap(key, oldValue, newValue string) (bool, error)
+	DeleteIfEquals(key, value string) (bool, error)
+}
+
+// Stores that can merge their files on demand to reclaim the space of deleted keys
+type Compacter interface {
+	CompactRange(start, end string) error
+	CompactAll() error
+}
+
+// Stores that can describe how their data is laid out on disk
+type StatsReporter interface {
+	Stats() string
 }
 
 // Available database versions
 var dbRegistry = map[string]func() (KVStore, error){
-	"v1": func() (KVStore, error) { return v1.NewV1Store(), nil },
-	"v2": func() (KVStore, error) { return v2.NewV2Store(), nil },
-	"v3": func() (KVStore, error) { return v3.NewV3Store(), nil },
-	"v4": func() (KVStore, error) { return v4.NewV4Store(), nil },
-	"v4_idx": func() (KVStore, error) { return v4_idx.NewV4Store(), nil },
-	"v5": func() (KVStore, error) { return v5.NewV5Store(), nil },
-	"v6": func() (KVStore, error) { return v6.NewV6Store(), nil },
+	"v1": func() (KVStore, error) { return openStore(v1.NewV1Store()) },
+	"v2": func() (KVStore, error) { return openStore(v2.NewV2Store()) },
+	"v3": func() (KVStore, error) { return openStore(v3.NewV3Store()) },
+	"v4": func() (KVStore, error) { return openStore(v4.NewV4Store()) },
+	"v4_idx": func() (KVStore, error) { return openStore(v4_idx.NewV4Store()) },
+	"v5": func() (KVStore, error) { return openStore(v5.NewV5Store()) },
+	"v6": func() (KVStore, error) { return openStore(v6.NewV6Store()) },
+}
+
+// Returns a nil KVStore when the constructor fails, not an interface holding a nil pointer
+func openStore[T KVStore](store T, err error) (KVStore, error) {
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
 }
 
 const defaultVersion = "v6"
@@ -137,15 +162,34 @@ func executeCommand(db KVStore, args []string) error {
 		}
 		return nil
 
+	case "setnx", "cas", "delifeq":
+		value, err := executeConditional(db, args)
+		if err != nil {
+			return err
+		}
+		fmt.Println(value)
+		return nil
+
+	case "compact":
+		return executeCompact(db, args)
+
+	case "stats":
+		stats, err := executeStats(db, args)
+		if err != nil {
+			return err
+		}
+		fmt.Println(stats)
+		return nil
+
 	default:
-		return fmt.Errorf("unknown command '%s'. Available commands: add, search, update, delete", command)
+		return fmt.Errorf("unknown command '%s'. Available commands: add, search, update, delete, setnx, cas, delifeq, compact, stats", command)
 	}
 }
 
 // Interactive REPL session
 func runInteractive(db KVStore, version string) {
 	fmt.Printf("KV Database %s - Interactive Mode\n", version)
-	fmt.Println("Commands: add <key> <value> | search <key> | update <key> <value> | delete <key> | exit | help")
+	fmt.Println("Commands: add <key> <value> | search <key> | update <key> <value> | delete <key> | setnx <key> <value> | cas <key> <old> <new> | delifeq <key> <value> | compact [start] [end] | stats | exit | help")
 	fmt.Println()
 
 	scanner := bufio.NewScanner(os.Stdin)
@@ -195,6 +239,11 @@ func printHelp() {
 	fmt.Println("  search <key>           - Get the value of a key")
 	fmt.Println("  update <key> <value>   - Update an existing key")
 	fmt.Println("  delete <key>           - Delete a key")
+	fmt.Println("  setnx <key> <value>    - Add a key only if it doesn't exist")
+	fmt.Println("  cas <key> <old> <new>  - Update a key only if its value is old")
+	fmt.Println("  delifeq <key> <value>  - Delete a key only if its value is value")
+	fmt.Println("  compact [start] [end]  - Merge the files with keys in [start, end) down to the last tier")
+	fmt.Println("  stats                  - Show the storage, block cache and compaction stats")
 	fmt.Println("  help                   - Show this help message")
 	fmt.Println("  version                - Show current database version")
 	fmt.Println("  exit                   - Exit interactive mode")
@@ -2,27 +2,57 @@ package v1
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+
+	"kv-store/kverrors"
+)
+
+// Get, Update and Delete return ErrNotFound when the key isn't in the file,
+// anything after Close returns ErrClosed
+var (
+	ErrNotFound	= kverrors.ErrNotFound
+	ErrClosed		= kverrors.ErrClosed
 )
 
 type V1Store struct {
+	mu       sync.Mutex // Serializes writes, conditional writes check and write without anyone in between
 	filePath string
+	closed   atomic.Bool
+}
+
+func NewV1Store() (*V1Store, error) {
+	return Open(filepath.Join("v1", "data"))
 }
 
-func NewV1Store() *V1Store {
-	dataDir := filepath.Join("v1", "data")
-	os.MkdirAll(dataDir, 0755)
+// Opens (or creates) a store in dir
+func Open(dir string) (*V1Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
 
 	return &V1Store{
-		filePath: filepath.Join(dataDir, "db.txt"),
-	}
+		filePath: filepath.Join(dir, "db.txt"),
+	}, nil
 }
 
 // Sets a key-value pair in the database by appending to the file
 func (s *V1Store) Set(key, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed.Load() {
+		return ErrClosed
+	}
+	return s.appendKV(key, value)
+}
+
+func (s *V1Store) appendKV(key, value string) error {
 	file, err := os.OpenFile(s.filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return err
@@ -35,10 +65,13 @@ func (s *V1Store) Set(key, value string) error {
 
 // Gets a value from the database reading line by line until it finds a match
 func (s *V1Store) Get(key string) (string, error) {
+	if s.closed.Load() {
+		return "", ErrClosed
+	}
 	file, err := os.Open(s.filePath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return "", fmt.Errorf("key not found: %s", key)
+			return "", fmt.Errorf("%w: %s", ErrNotFound, key)
 		}
 		return "", err
 	}
@@ -53,7 +86,7 @@ func (s *V1Store) Get(key string) (string, error) {
 		}
 	}
 
-	return "", fmt.Errorf("key not found: %s", key)
+	return "", fmt.Errorf("%w: %s", ErrNotFound, key)
 }
 
 // Updates a key-value pair in the database by rewriting the file
@@ -66,13 +99,23 @@ func (s *V1Store) Delete(key string) error {
 	return s.modifyKey(key, nil)
 }
 
+func (s *V1Store) modifyKey(key string, value *string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed.Load() {
+		return ErrClosed
+	}
+	return s.rewriteKey(key, value)
+}
+
 // Creates a temp file and dumps the contents of the db file
 // except the modified KV pair, then it overwrites the original
-func (s *V1Store) modifyKey(key string, value *string) error {
+func (s *V1Store) rewriteKey(key string, value *string) error {
 	input, err := os.Open(s.filePath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return fmt.Errorf("key not found: %s", key)
+			return fmt.Errorf("%w: %s", ErrNotFound, key)
 		}
 		return err
 	}
@@ -107,7 +150,7 @@ func (s *V1Store) modifyKey(key string, value *string) error {
 
 	if !found {
 		os.Remove(tempFile)
-		return fmt.Errorf("key not found: %s", key)
+		return fmt.Errorf("%w: %s", ErrNotFound, key)
 	}
 
 	output.Close()
@@ -116,6 +159,47 @@ func (s *V1Store) modifyKey(key string, value *string) error {
 	return os.Rename(tempFile, s.filePath)
 }
 
+// Sets the key only if it doesn't exist, returns false if it already did
+func (s *V1Store) SetIfAbsent(key, value string) (bool, error) {
+	return s.writeIf(key, func(current string, found bool) bool { return !found }, func() error {
+		return s.appendKV(key, value)
+	})
+}
+
+// Replaces the value only if it's still oldValue, a missing key never matches
+func (s *V1Store) CompareAndSwap(key, oldValue, newValue string) (bool, error) {
+	return s.writeIf(key, func(current string, found bool) bool { return found && current == oldValue }, func() error {
+		return s.rewriteKey(key, &newValue)
+	})
+}
+
+// Deletes the key only if its value is still value
+func (s *V1Store) DeleteIfEquals(key, value string) (bool, error) {
+	return s.writeIf(key, func(current string, found bool) bool { return found && current == value }, func() error {
+		return s.rewriteKey(key, nil)
+	})
+}
+
+// Reads the current value and writes while holding the write lock
+// Returns false without writing if cond doesn't hold
+func (s *V1Store) writeIf(key string, cond func(current string, found bool) bool, write func() error) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, err := s.Get(key)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return false, err
+	}
+	if !cond(current, err == nil) {
+		return false, nil
+	}
+	if err := write(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 func (s *V1Store) Close() error {
+	s.closed.Store(true)
 	return nil
 }
\ No newline at end of file
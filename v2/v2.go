@@ -2,43 +2,87 @@ package v2
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+
+	"kv-store/kverrors"
+)
+
+// A key whose last record is a tombstone is ErrNotFound, same as one that was never written
+var (
+	ErrNotFound	= kverrors.ErrNotFound
+	ErrClosed		= kverrors.ErrClosed
 )
 
 type V2Store struct {
+	mu       sync.Mutex // Serializes appends, conditional writes check and append without anyone in between
 	filePath string
+	closed   atomic.Bool
+}
+
+func NewV2Store() (*V2Store, error) {
+	return Open(filepath.Join("v2", "data"))
 }
 
-func NewV2Store() *V2Store {
-	dataDir := filepath.Join("v2", "data")
-	os.MkdirAll(dataDir, 0755)
+// Opens (or creates) a store in dir
+func Open(dir string) (*V2Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
 
 	return &V2Store{
-		filePath: filepath.Join(dataDir, "db.txt"),
-	}
+		filePath: filepath.Join(dir, "db.txt"),
+	}, nil
 }
 
 // Sets a key-value pair in the database by appending to the file
 func (s *V2Store) Set(key string, value string) error {
+	return s.write(formatRecord(key, value, false))
+}
+
+func (s *V2Store) write(record string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed.Load() {
+		return ErrClosed
+	}
+	return s.appendRecord(record)
+}
+
+func (s *V2Store) appendRecord(record string) error {
 	file, err := os.OpenFile(s.filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 	
-	_, err = fmt.Fprintf(file, "%s:%s\n", key, value)
+	_, err = file.WriteString(record)
 	return err
 }
 
+// Values are "key:value" lines, a tombstone is the key alone on its line
+func formatRecord(key, value string, deleted bool) string {
+	if deleted {
+		return key + "\n"
+	}
+	return key + ":" + value + "\n"
+}
+
 // Reads the entire file to find the last match
 func (s *V2Store) Get(key string) (string, error) {
+	if s.closed.Load() {
+		return "", ErrClosed
+	}
 	file, err := os.Open(s.filePath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return "", fmt.Errorf("key not found: %s", key)
+			return "", fmt.Errorf("%w: %s", ErrNotFound, key)
 		}
 		return "", err
 	}
@@ -49,21 +93,20 @@ func (s *V2Store) Get(key string) (string, error) {
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
 		line := scanner.Text()
-		parts := strings.SplitN(line, ":", 2)
-		if len(parts) == 2 && parts[0] == key {
-			// We keep track of the last value of the key we are looking for
-			val := parts[1]
+		k, val, isPut := strings.Cut(line, ":")
+		if k != key {
+			continue
+		}
+		// We keep track of the last value of the key we are looking for, a tombstone record clears it
+		if isPut {
 			lastValue = &val
+		} else {
+			lastValue = nil
 		}
 	}
 
   if lastValue == nil {
-		return "", fmt.Errorf("key not found: %s", key)
-	}
-
-	// If the value is "null" this means it was deleted ("null" is our tombstone record)
-	if *lastValue == "null" {
-		return "", fmt.Errorf("key not found: %s", key)
+		return "", fmt.Errorf("%w: %s", ErrNotFound, key)
 	}
 
 	return *lastValue, nil
@@ -74,11 +117,46 @@ func (s *V2Store) Update(key, value string) error {
 	return s.Set(key, value)
 }
 
-// Deletes a key-value pair in the database by appending a tombstone record (`null` value) to the file
+// Deletes a key-value pair in the database by appending a tombstone record (the key without a value) to the file
 func (s *V2Store) Delete(key string) error {
-	return s.Set(key, "null")
+	return s.write(formatRecord(key, "", true))
+}
+
+// Appends the pair if scanning the file finds no value for the key (never written, or deleted last)
+func (s *V2Store) SetIfAbsent(key, value string) (bool, error) {
+	return s.appendIf(key, formatRecord(key, value, false), func(current string, found bool) bool { return !found })
+}
+
+// Appends newValue if the last value of the key in the file is oldValue, a missing key never matches
+func (s *V2Store) CompareAndSwap(key, oldValue, newValue string) (bool, error) {
+	return s.appendIf(key, formatRecord(key, newValue, false), func(current string, found bool) bool { return found && current == oldValue })
+}
+
+// Appends a tombstone record if the last value of the key in the file is still value
+func (s *V2Store) DeleteIfEquals(key, value string) (bool, error) {
+	return s.appendIf(key, formatRecord(key, "", true), func(current string, found bool) bool { return found && current == value })
+}
+
+// Scans for the last value and appends the record while holding the write lock, so no other append lands in between
+// Returns false without writing if cond doesn't hold
+func (s *V2Store) appendIf(key, record string, cond func(current string, found bool) bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, err := s.Get(key)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return false, err
+	}
+	if !cond(current, err == nil) {
+		return false, nil
+	}
+	if err := s.appendRecord(record); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
 func (s *V2Store) Close() error {
+	s.closed.Store(true)
 	return nil
 }
\ No newline at end of file
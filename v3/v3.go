@@ -2,25 +2,42 @@ package v3
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+
+	"kv-store/kverrors"
+)
+
+// ErrCorrupt means the index pointed at a line that isn't a record of the key
+var (
+	ErrNotFound	= kverrors.ErrNotFound
+	ErrCorrupt	= kverrors.ErrCorrupt
+	ErrClosed		= kverrors.ErrClosed
 )
 
 type V3Store struct {
 	mu 				sync.RWMutex
 	filePath 	string
 	index 		map[string]int64
+	closed		bool
 }
 
-func NewV3Store() *V3Store {
-	dataDir := filepath.Join("v3", "data")
-	os.MkdirAll(dataDir, 0755)
+func NewV3Store() (*V3Store, error) {
+	return Open(filepath.Join("v3", "data"))
+}
+
+// Opens (or creates) a store in dir
+func Open(dir string) (*V3Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
 
-	filePath := filepath.Join(dataDir, "db.txt")
+	filePath := filepath.Join(dir, "db.txt")
 	index := make(map[string]int64)
 	if _, err := os.Stat(filePath); err == nil {
 		index = rebuildIndex(filePath) // If we have a file at startup, we build the index
@@ -29,19 +46,31 @@ func NewV3Store() *V3Store {
 	return &V3Store{
 		filePath: filePath,
 		index: index,
-	}
+	}, nil
 }
 
 func (s *V3Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
 	return nil
 }
 
 // Appends to the file and updates the index
-// For tombstone values, it updates the index instead of deleting the record
 func (s *V3Store) Set(key string, value string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.closed {
+		return ErrClosed
+	}
+	return s.set(key, value, false)
+}
+
+// Expects s.mu to be locked
+// For tombstones, it removes the key from the index instead of pointing it to the record
+func (s *V3Store) set(key, value string, deleted bool) error {
 	// Get the current offset, which is actually the size before write
 	var byteOffset int64 = 0
 	info, err := os.Stat(s.filePath)
@@ -56,12 +85,12 @@ func (s *V3Store) Set(key string, value string) error {
 	defer file.Close()
 
 	// Write to file
-	if _, err = fmt.Fprintf(file, "%s:%s\n", key, value); err != nil {
+	if _, err = file.WriteString(formatEntry(key, value, deleted)); err != nil {
 		return err
 	}
 
 	// Update index after successful write. If tombstone, remove from index
-	if value == "null" {
+	if deleted {
 		delete(s.index, key)
 	} else {
 		s.index[key] = byteOffset 
@@ -75,12 +104,20 @@ func (s *V3Store) Set(key string, value string) error {
 func (s *V3Store) Get(key string) (string, error) {
 	s.mu.RLock()
 	offset, exists := s.index[key]
+	closed := s.closed
 	s.mu.RUnlock()
-	
+
+	if closed {
+		return "", ErrClosed
+	}
 	if !exists {
-		return "", fmt.Errorf("key not found: %s", key)
+		return "", fmt.Errorf("%w: %s", ErrNotFound, key)
 	}
+	return s.readValue(key, offset)
+}
 
+// Reads the record at offset, it has to belong to key
+func (s *V3Store) readValue(key string, offset int64) (string, error) {
 	file, err := os.Open(s.filePath)
 	if err != nil {
 		return "", err
@@ -97,14 +134,14 @@ func (s *V3Store) Get(key string) (string, error) {
 		return "", fmt.Errorf("failed to read line at offset %d: %w", offset, err)
 	}
 
-	k, v, err := parseEntry(line)
+	k, v, deleted, err := parseEntry(line)
 	if err != nil || k != key {
-		return "", fmt.Errorf("corrupted data at offset %d", offset)
+		return "", fmt.Errorf("%w: bad record at offset %d", ErrCorrupt, offset)
 	}
 
 	// Handle tombstones
-	if v == "null" {
-		return "", fmt.Errorf("key not found: %s", key)
+	if deleted {
+		return "", fmt.Errorf("%w: %s", ErrNotFound, key)
 	}
 
 	return v, nil
@@ -115,9 +152,61 @@ func (s *V3Store) Update(key, value string) error {
 	return s.Set(key, value)
 }
 
-// Deletes a key-value pair in the database by appending a tombstone record (`null` value) to the file
+// Deletes a key-value pair in the database by appending a tombstone record (the key without a value) to the file
 func (s *V3Store) Delete(key string) error {
-	return s.Set(key, "null")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	return s.set(key, "", true)
+}
+
+// Appends the pair if the index has no offset for the key, deletes drop keys from the index so they count as absent
+func (s *V3Store) SetIfAbsent(key, value string) (bool, error) {
+	return s.setIf(key, value, false, func(current string, found bool) bool { return !found })
+}
+
+// Appends newValue if the record the index points to still holds oldValue
+func (s *V3Store) CompareAndSwap(key, oldValue, newValue string) (bool, error) {
+	return s.setIf(key, newValue, false, func(current string, found bool) bool { return found && current == oldValue })
+}
+
+// Appends a tombstone and drops the key from the index if the indexed record still holds value
+func (s *V3Store) DeleteIfEquals(key, value string) (bool, error) {
+	return s.setIf(key, "", true, func(current string, found bool) bool { return found && current == value })
+}
+
+// Reads the current value through the index and appends while holding the write lock
+// Nothing is written when cond doesn't hold
+func (s *V3Store) setIf(key, value string, deleted bool, cond func(current string, found bool) bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false, ErrClosed
+	}
+
+	var current string
+	offset, found := s.index[key]
+	if found {
+		var err error
+		current, err = s.readValue(key, offset)
+		if errors.Is(err, ErrNotFound) {
+			found = false
+		} else if err != nil {
+			return false, err
+		}
+	}
+
+	if !cond(current, found) {
+		return false, nil
+	}
+	if err := s.set(key, value, deleted); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
 // Goes over the file to rebuild the index with each key's offset
@@ -135,7 +224,7 @@ func rebuildIndex(filePath string) map[string]int64 {
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
 		line := scanner.Text()
-		if k, _, err := parseEntry(line); err == nil {
+		if k, _, _, err := parseEntry(line); err == nil {
 			keyValues[k] = offset	// Store the offset where the record starts
 		}
 		offset += int64(len(line)) + 1 // Make sure to add the newline value ('\n' == 1) to the offset 
@@ -144,11 +233,20 @@ func rebuildIndex(filePath string) map[string]int64 {
 	return keyValues
 }
 
-// "key:value\n" parser
-func parseEntry(line string) (key, value string, err error) {
-	parts := strings.SplitN(strings.TrimSpace(line), ":", 2)
-	if len(parts) != 2 {
-		return "", "", fmt.Errorf("invalid entry format")
+// Values are "key:value\n" records, a tombstone is "key\n"
+func formatEntry(key, value string, deleted bool) string {
+	if deleted {
+		return key + "\n"
+	}
+	return key + ":" + value + "\n"
+}
+
+// Parser for the records written by formatEntry
+func parseEntry(line string) (key, value string, deleted bool, err error) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return "", "", false, fmt.Errorf("invalid entry format")
 	}
-	return parts[0], parts[1], nil
+	key, value, isPut := strings.Cut(line, ":")
+	return key, value, !isPut, nil
 }
\ No newline at end of file
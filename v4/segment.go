@@ -14,6 +14,12 @@ type Segment struct {
 	DataDir	string	
 }
 
+// A value, or a tombstone if Deleted is set
+type Record struct {
+	Value		string
+	Deleted	bool
+}
+
 type SegmentSearchResult struct {
 	Value 	string
 	Found 	bool 		// true if key exists in this segment
@@ -50,19 +56,36 @@ func (seg *Segment) SetReadOnly() error {
 	return os.Chmod(seg.Path, 0o444)
 }
 
-func (seg *Segment) Append(key, value string) error {
+func (seg *Segment) Append(key string, record Record) error {
 	file, err := os.OpenFile(seg.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 	
-	_, err = fmt.Fprintf(file, "%s:%s\n", key, value)
+	_, err = file.WriteString(formatRecord(key, record))
 	return err
 }
 
+// Values are written as "key:value\n", tombstones as "key\n"
+func formatRecord(key string, record Record) string {
+	if record.Deleted {
+		return key + "\n"
+	}
+	return key + ":" + record.Value + "\n"
+}
+
+// Parses a line written by formatRecord, ok is false for empty lines
+func parseRecord(line string) (key string, record Record, ok bool) {
+	if line == "" {
+		return "", Record{}, false
+	}
+	key, value, isPut := strings.Cut(line, ":")
+	return key, Record{Value: value, Deleted: !isPut}, true
+}
+
 // Writes all records to the segment file, also used for compaction
-func (seg *Segment) WriteRecords(records map[string]string) error {
+func (seg *Segment) WriteRecords(records map[string]Record) error {
 	tempPath := seg.Path + ".tmp"
 	tempFile, err := os.Create(tempPath)
 	if err != nil {
@@ -70,8 +93,8 @@ func (seg *Segment) WriteRecords(records map[string]string) error {
 	}
 
 	// Write compacted records to temp file 
-	for key, value := range records {
-		if _, err := fmt.Fprintf(tempFile, "%s:%s\n", key, value); err != nil {
+	for key, record := range records {
+		if _, err := tempFile.WriteString(formatRecord(key, record)); err != nil {
 			tempFile.Close()
 			os.Remove(tempPath)
 			return fmt.Errorf("write record: %w", err)
@@ -95,26 +118,24 @@ func (seg *Segment) WriteRecords(records map[string]string) error {
 
 // Reads all KV pairs from the segment still reads the entire file line by line
 // this will be used when compacting segments after rotation
-func (seg *Segment) ReadAllRecords() (map[string]string, error) {
+func (seg *Segment) ReadAllRecords() (map[string]Record, error) {
 	file, err := os.Open(seg.Path)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return make(map[string]string), nil // Empty segment
+			return make(map[string]Record), nil // Empty segment
 		}
 		return nil, err
 	}
 	defer file.Close()
 	
 	// Hashmap to read the segment and deduplicate
-	records := make(map[string]string)
+	records := make(map[string]Record)
 
 	// Read the entire file and map it onto a hashmap
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.SplitN(line, ":", 2)
-		if len(parts) == 2 {
-			records[parts[0]] = parts[1] // Last write wins, deduplicates but keeps tombstones
+		if key, record, ok := parseRecord(scanner.Text()); ok {
+			records[key] = record // Last write wins, deduplicates but keeps tombstones
 		}
 	}
 
@@ -133,15 +154,14 @@ func (seg *Segment) FindKey(key string) (SegmentSearchResult, error) {
 	}
 	defer file.Close()
 
-	var foundValue string
+	var foundRecord Record
 	found := false
 
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.SplitN(line, ":", 2)
-		if len(parts) == 2 && parts[0] == key {
-			foundValue = parts[1]	// Keep track of the last value for this key
+		k, record, ok := parseRecord(scanner.Text())
+		if ok && k == key {
+			foundRecord = record	// Keep track of the last record for this key
 			found = true
 		}
 	}
@@ -153,9 +173,9 @@ func (seg *Segment) FindKey(key string) (SegmentSearchResult, error) {
 		return SegmentSearchResult{}, nil // Not found in this segment
 	}
 	
-	if foundValue == tombstoneValue {
+	if foundRecord.Deleted {
 		return SegmentSearchResult{Found: true, Deleted: true}, nil // Found but is a tombstone
 	}
 
-	return SegmentSearchResult{Value: foundValue, Found: true}, nil
+	return SegmentSearchResult{Value: foundRecord.Value, Found: true}, nil
 }
\ No newline at end of file
@@ -16,8 +16,7 @@ type SegmentManager struct {
 }
 
 type compactionRequest struct {
-	segmentID      int
-	tombstoneValue string
+	segmentID int
 }
 
 func NewSegmentManager(dataDir string) *SegmentManager {
@@ -71,7 +70,7 @@ func (sm *SegmentManager) CreateSegment(id int) (*Segment, error) {
 }
 
 // Creates a new segment and sets the old one to readonly when Set() calls it
-func (sm *SegmentManager) RotateSegment(oldSegment *Segment, tombstoneValue string) (*Segment, error) {
+func (sm *SegmentManager) RotateSegment(oldSegment *Segment) (*Segment, error) {
 	// Create new segment with next id
 	newSegment, err := sm.CreateSegment(oldSegment.ID + 1)
 	if err != nil {
@@ -85,7 +84,7 @@ func (sm *SegmentManager) RotateSegment(oldSegment *Segment, tombstoneValue stri
 
 	// Send old segment to the compaction background runner
 	select {
-	case sm.compactCh <- compactionRequest{segmentID: oldSegment.ID, tombstoneValue: tombstoneValue}:
+	case sm.compactCh <- compactionRequest{segmentID: oldSegment.ID}:
 	default:
 		// Channel is full so we skip compaction
 	}
@@ -1,13 +1,31 @@
 package v4
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"sync"
+
+	"kv-store/kverrors"
+)
+
+// Get stops at the newest segment that has the key, a tombstone there is ErrNotFound
+var (
+	ErrNotFound	= kverrors.ErrNotFound
+	ErrClosed		= kverrors.ErrClosed
 )
 
-const tombstoneValue = "null"
+// Tunables for Open, zero fields get the default value
+type Options struct {
+	MaxSegmentSize	int64	// Bytes before the active segment is rotated
+}
+
+func DefaultOptions() Options {
+	return Options{
+		MaxSegmentSize: 75, // Small max size ~8 lines
+	}
+}
 
 type V4Store struct {
 	mu             sync.RWMutex
@@ -16,18 +34,27 @@ type V4Store struct {
 	activeSegment  *Segment
 	maxSegmentSize int64
 	manager        *SegmentManager
+	closed         bool
 }
 
-func NewV4Store() *V4Store {
-	dataDir := filepath.Join("v4", "data")
+func NewV4Store() (*V4Store, error) {
+	return Open(filepath.Join("v4", "data"), DefaultOptions())
+}
+
+// Opens (or creates) a store in dir
+func Open(dataDir string, opts Options) (*V4Store, error) {
+	if opts.MaxSegmentSize <= 0 {
+		opts.MaxSegmentSize = DefaultOptions().MaxSegmentSize
+	}
 	if err := os.MkdirAll(dataDir, 0755); err != nil {
-    panic(fmt.Sprintf("failed to create data directory: %v", err))
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
 	}
 
 	manager := NewSegmentManager(dataDir)
 	segments, err := manager.DiscoverSegments()
 	if err != nil {
-		panic(fmt.Sprintf("failed to discover segments: %v", err))
+		manager.Close()
+		return nil, fmt.Errorf("failed to discover segments: %w", err)
 	}
 
 	// If theres no existing segments we create an empty segment #1 on disk
@@ -35,7 +62,8 @@ func NewV4Store() *V4Store {
 		seg := NewSegment(dataDir, 1)
 		file, err := os.Create(seg.Path)
 		if err != nil {
-			panic(fmt.Sprintf("failed to create initial segment: %v", err))
+			manager.Close()
+			return nil, fmt.Errorf("failed to create initial segment: %w", err)
 		}
 		file.Close()
 		segments = []*Segment{seg}
@@ -48,14 +76,22 @@ func NewV4Store() *V4Store {
 		dataDir:						dataDir,
 		segments:						segments,
 		activeSegment:			activeSegment,
-		maxSegmentSize:			75, // Small max size ~8 lines
+		maxSegmentSize:			opts.MaxSegmentSize,
 		manager: 						manager,
 	}
 
-	return store
+	return store, nil
 }
 
 func (s *V4Store) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+
 	s.manager.Close()
 	return nil
 }
@@ -66,20 +102,28 @@ func (s *V4Store) Set(key string, value string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.closed {
+		return ErrClosed
+	}
+	return s.set(key, Record{Value: value})
+}
+
+// Expects s.mu to be locked
+func (s *V4Store) set(key string, record Record) error {
 	currentSize, err := s.activeSegment.Size()
 	if err != nil {
 		currentSize = 0
 	}
 	
-	// Write size of the new KV pair
-	writeSize := int64(len(key) + len(value) + 2) // key:value\n
+	// Write size of the new record
+	writeSize := int64(len(formatRecord(key, record)))
 
 	// If current size + new pair is bigger than max, rotate the segment
 	if currentSize + writeSize >= s.maxSegmentSize {
 		oldSegment := s.activeSegment
 
 		// Send it off to the manager for segment rotation and compaction
-		newSegment, err := s.manager.RotateSegment(oldSegment, tombstoneValue)
+		newSegment, err := s.manager.RotateSegment(oldSegment)
 		if err != nil {
 			return err
 		}
@@ -89,17 +133,26 @@ func (s *V4Store) Set(key string, value string) error {
 		s.segments = append(s.segments, newSegment)
 	}
 
-	return s.activeSegment.Append(key, value)
+	return s.activeSegment.Append(key, record)
 }
 
 // Reads segments from newest to oldest to find a key
 // It still has to read the entire file but segmenting keeps them small
 func (s *V4Store) Get(key string) (string, error) {
 	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return "", ErrClosed
+	}
 	segments := make([]*Segment, len(s.segments)) // Copying the array to release the lock asap
 	copy(segments, s.segments)
 	s.mu.RUnlock()
 
+	return findInSegments(segments, key)
+}
+
+// Segments are ordered oldest to newest
+func findInSegments(segments []*Segment, key string) (string, error) {
 	// Search segments from newest to oldest
 	for i := len(segments) - 1; i >= 0; i-- {
 		result, err := segments[i].FindKey(key)
@@ -112,13 +165,13 @@ func (s *V4Store) Get(key string) (string, error) {
 		}
 
 		if result.Deleted {
-			return "", fmt.Errorf("key not found: %s", key)
+			return "", fmt.Errorf("%w: %s", ErrNotFound, key)
 		}
 
 		return result.Value, nil
 	}
 
-	return "", fmt.Errorf("key not found: %s", key)
+	return "", fmt.Errorf("%w: %s", ErrNotFound, key)
 }
 
 // Updates a key-value pair in the database by appending an updated value to the file
@@ -126,7 +179,51 @@ func (s *V4Store) Update(key, value string) error {
 	return s.Set(key, value)
 }
 
-// Deletes a key-value pair in the database by appending a tombstone record (`null` value) to the file
+// Deletes a key-value pair in the database by appending a tombstone record to the file
 func (s *V4Store) Delete(key string) error {
-	return s.Set(key, tombstoneValue)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	return s.set(key, Record{Deleted: true})
+}
+
+// Appends to the active segment if no segment has a value for the key, a tombstone in a newer segment counts as absent
+func (s *V4Store) SetIfAbsent(key, value string) (bool, error) {
+	return s.setIf(key, Record{Value: value}, func(current string, found bool) bool { return !found })
+}
+
+// Appends newValue to the active segment if the newest value across the segments is oldValue
+func (s *V4Store) CompareAndSwap(key, oldValue, newValue string) (bool, error) {
+	return s.setIf(key, Record{Value: newValue}, func(current string, found bool) bool { return found && current == oldValue })
+}
+
+// Appends a tombstone to the active segment if the newest value is still value
+func (s *V4Store) DeleteIfEquals(key, value string) (bool, error) {
+	return s.setIf(key, Record{Deleted: true}, func(current string, found bool) bool { return found && current == value })
+}
+
+// Searches the segments newest first and appends while holding the write lock, so no rotation or other write
+// happens in between. Returns false without writing if cond doesn't hold
+func (s *V4Store) setIf(key string, record Record, cond func(current string, found bool) bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false, ErrClosed
+	}
+
+	current, err := findInSegments(s.segments, key)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return false, err
+	}
+	if !cond(current, err == nil) {
+		return false, nil
+	}
+	if err := s.set(key, record); err != nil {
+		return false, err
+	}
+	return true, nil
 }
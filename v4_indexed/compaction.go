@@ -12,7 +12,7 @@ func (sm *SegmentManager) compactionWorker() {
 		case <-sm.stopCompaction:
 			return
 		case req := <-sm.compactCh:
-			if err := sm.compactSegment(req.segmentId, req.tombstoneValue, req.indexSnapshot); err != nil {
+			if err := sm.compactSegment(req.segmentId, req.indexSnapshot); err != nil {
 				fmt.Printf("Compaction error for segment %d: %v\n", req.segmentId, err)
 			}
 		}
@@ -22,7 +22,7 @@ func (sm *SegmentManager) compactionWorker() {
 // This function loads the old segment records onto an in-memory hashmap to deduplicate
 // after that, it removes the deleted KVs (tombstone values) and writes a temp file
 // finally it replaces the original file with the newly compacted temp file
-func (sm *SegmentManager) compactSegment(segId int, tombstoneValue string, globalIndex map[string]SegmentLocation) error {
+func (sm *SegmentManager) compactSegment(segId int, globalIndex map[string]SegmentLocation) error {
 	seg := NewSegment(sm.DataDir, segId)
 
 	// Read all records from the segment (already handles deduplication)
@@ -35,7 +35,7 @@ func (sm *SegmentManager) compactSegment(segId int, tombstoneValue string, globa
 	compactedRecords := make(map[string]string)
 	for _, entry := range segmentEntries {
 		if loc, exists := globalIndex[entry.Key]; exists && loc.SegmentId == segId {
-			if entry.Value != tombstoneValue {
+			if !entry.Deleted {
 				compactedRecords[entry.Key] = entry.Value
 			}
 		}
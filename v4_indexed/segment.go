@@ -18,6 +18,7 @@ type Segment struct {
 type SegmentEntry struct {
 	Key		 	string
 	Value 	string
+	Deleted	bool		// Tombstone record, Value is empty
 	Offset	int64
 }
 
@@ -51,14 +52,14 @@ func (seg *Segment) SetReadOnly() error {
 	return os.Chmod(seg.Path, 0o444)
 }
 
-func (seg *Segment) Append(key, value string) error {
+func (seg *Segment) Append(key, value string, deleted bool) error {
 	file, err := os.OpenFile(seg.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 	
-	_, err = fmt.Fprintf(file, "%s:%s\n", key, value)
+	_, err = file.WriteString(formatEntry(key, value, deleted))
 	return err
 }
 
@@ -76,7 +77,7 @@ func (seg *Segment) WriteRecords(records map[string]string) (map[string]int64, e
 	// Write compacted records to temp file and keep track of new offsets
 	for key, value := range records {
 		newOffsets[key] = offset
-		line := fmt.Sprintf("%s:%s\n", key, value)
+		line := formatEntry(key, value, false)
 
 		if _, err := tempFile.WriteString(line); err != nil {
 			tempFile.Close()
@@ -122,10 +123,11 @@ func (seg *Segment) ReadAllEntries() ([]SegmentEntry, error) {
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
 		line := scanner.Text()
-		if k, v, err := parseEntry(line); err == nil {
+		if k, v, deleted, err := parseEntry(line); err == nil {
 			entries = append(entries, SegmentEntry{
 				Key: 		k,
 				Value: 	v,
+				Deleted: deleted,
 				Offset: offset,
 			})
 		}
@@ -22,9 +22,8 @@ type IndexUpdate struct {
 }
 
 type compactionRequest struct {
-	segmentId				int
-	tombstoneValue	string
-	indexSnapshot		map[string]SegmentLocation
+	segmentId			int
+	indexSnapshot	map[string]SegmentLocation
 }
 
 func NewSegmentManager(dataDir string) *SegmentManager {
@@ -81,7 +80,6 @@ func (sm *SegmentManager) CreateSegment(id int) (*Segment, error) {
 // Creates a new segment and sets the old one to readonly when Set() calls it
 func (sm *SegmentManager) RotateSegment(
 	oldSegment *Segment,
-	tombstoneValue string,
 	indexSnapshot map[string]SegmentLocation,
 ) (*Segment, error) {
 	// Create new segment with next id
@@ -99,7 +97,6 @@ func (sm *SegmentManager) RotateSegment(
 	select {
 	case sm.compactCh <- compactionRequest{
 		segmentId: oldSegment.Id,
-		tombstoneValue: tombstoneValue,
 		indexSnapshot: indexSnapshot,
 	}:
 	default:
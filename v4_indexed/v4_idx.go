@@ -1,14 +1,33 @@
 package v4_idx
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+
+	"kv-store/kverrors"
+)
+
+// ErrCorrupt means an index location doesn't hold a record of the key anymore
+var (
+	ErrNotFound	= kverrors.ErrNotFound
+	ErrCorrupt	= kverrors.ErrCorrupt
+	ErrClosed		= kverrors.ErrClosed
 )
 
-const tombstoneValue = "null"
+// Tunables for Open, zero fields get the default value
+type Options struct {
+	MaxSegmentSize	int64	// Bytes before the active segment is rotated
+}
+
+func DefaultOptions() Options {
+	return Options{
+		MaxSegmentSize: 75, // Small max size ~8 lines
+	}
+}
 
 type SegmentLocation struct {
 	SegmentId	int
@@ -21,19 +40,28 @@ type V4IdxStore struct {
 	activeSegment  *Segment
 	maxSegmentSize int64
 	manager        *SegmentManager
+	closed         bool
 	index					 map[string]SegmentLocation
 }
 
-func NewV4Store() *V4IdxStore {
-	dataDir := filepath.Join("v4_indexed", "data")
+func NewV4Store() (*V4IdxStore, error) {
+	return Open(filepath.Join("v4_indexed", "data"), DefaultOptions())
+}
+
+// Opens (or creates) a store in dir
+func Open(dataDir string, opts Options) (*V4IdxStore, error) {
+	if opts.MaxSegmentSize <= 0 {
+		opts.MaxSegmentSize = DefaultOptions().MaxSegmentSize
+	}
 	if err := os.MkdirAll(dataDir, 0755); err != nil {
-    panic(fmt.Sprintf("failed to create data directory: %v", err))
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
 	}
 
 	manager := NewSegmentManager(dataDir)
 	segments, err := manager.DiscoverSegments()
 	if err != nil {
-		panic(fmt.Sprintf("failed to discover segments: %v", err))
+		manager.Close()
+		return nil, fmt.Errorf("failed to discover segments: %w", err)
 	}
 
 	// If theres no existing segments we create an empty segment #1 on disk
@@ -41,7 +69,8 @@ func NewV4Store() *V4IdxStore {
 		seg := NewSegment(dataDir, 1)
 		file, err := os.Create(seg.Path)
 		if err != nil {
-			panic(fmt.Sprintf("failed to create initial segment: %v", err))
+			manager.Close()
+			return nil, fmt.Errorf("failed to create initial segment: %w", err)
 		}
 		file.Close()
 		segments = []*Segment{seg}
@@ -54,21 +83,30 @@ func NewV4Store() *V4IdxStore {
 		dataDir:						dataDir,
 		segments:						segments,
 		activeSegment:			activeSegment,
-		maxSegmentSize:			75, // Small max size ~8 lines
+		maxSegmentSize:			opts.MaxSegmentSize,
 		manager: 						manager,
 		index: 							make(map[string]SegmentLocation),
 	}
 
 	if err := store.rebuildGlobalIndex(); err != nil {
-		panic(fmt.Sprintf("failed to rebuild index %v", err))
+		manager.Close()
+		return nil, fmt.Errorf("failed to rebuild index: %w", err)
 	}
 
 	go store.indexUpdateListener()
 
-	return store
+	return store, nil
 }
 
 func (s *V4IdxStore) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+
 	s.manager.Close()
 	return nil
 }
@@ -79,13 +117,21 @@ func (s *V4IdxStore) Set(key string, value string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.closed {
+		return ErrClosed
+	}
+	return s.set(key, value, false)
+}
+
+// Expects s.mu to be locked
+func (s *V4IdxStore) set(key, value string, deleted bool) error {
 	currentSize, err := s.activeSegment.Size()
 	if err != nil {
 		currentSize = 0
 	}
 	
-	// Write size of the new KV pair
-	writeSize := int64(len(key) + len(value) + 2) // key:value\n
+	// Write size of the new record
+	writeSize := int64(len(formatEntry(key, value, deleted)))
 
 	// Get the current offset, which is actually the size before write
 	offset := currentSize
@@ -100,7 +146,7 @@ func (s *V4IdxStore) Set(key string, value string) error {
 		}
 
 		// Send it off to the manager for segment rotation and compaction
-		newSegment, err := s.manager.RotateSegment(oldSegment, tombstoneValue, indexSnapshot)
+		newSegment, err := s.manager.RotateSegment(oldSegment, indexSnapshot)
 		if err != nil {
 			return err
 		}
@@ -114,12 +160,12 @@ func (s *V4IdxStore) Set(key string, value string) error {
 	}
 
 	// Write to file
-	if err = s.activeSegment.Append(key, value); err != nil {
+	if err = s.activeSegment.Append(key, value, deleted); err != nil {
 		return err
 	}
 
 	// Update index after successful write. If tombstone, remove from index
-	if value == "null" {
+	if deleted {
 		delete(s.index, key)
 	} else {
 		s.index[key] = SegmentLocation{
@@ -132,28 +178,37 @@ func (s *V4IdxStore) Set(key string, value string) error {
 
 func (s *V4IdxStore) Get(key string) (string, error) {
 	s.mu.RLock()
-	location, exists := s.index[key]
+	if s.closed {
+		s.mu.RUnlock()
+		return "", ErrClosed
+	}
+	targetSegment, location, err := s.locate(key)
 	s.mu.RUnlock()
-	
+	if err != nil {
+		return "", err
+	}
+
+	return readEntry(targetSegment, location, key)
+}
+
+// Finds the segment and offset of the key in the index, expects s.mu to be locked
+func (s *V4IdxStore) locate(key string) (*Segment, SegmentLocation, error) {
+	location, exists := s.index[key]
 	if !exists {
-		return "", fmt.Errorf("key not found: %s", key)
+		return nil, location, fmt.Errorf("%w: %s", ErrNotFound, key)
 	}
 
 	// Find the segment
-	s.mu.RLock()
-	var targetSegment *Segment
 	for _, seg := range s.segments {
 		if seg.Id == location.SegmentId {
-			targetSegment = seg
-			break
+			return seg, location, nil
 		}
 	}
-	s.mu.RUnlock()
-
-	if targetSegment == nil {
-		return "", fmt.Errorf("segment %d not found", location.SegmentId)
-	}
+	return nil, location, fmt.Errorf("segment %d not found", location.SegmentId)
+}
 
+// Reads the line at the location, it has to belong to key
+func readEntry(targetSegment *Segment, location SegmentLocation, key string) (string, error) {
 	// Call line reader on the target segment
 	line, err := targetSegment.Read(location.Offset)
 	if err != nil {
@@ -161,9 +216,9 @@ func (s *V4IdxStore) Get(key string) (string, error) {
 	}
 
 	// Make sure it matches the expected key
-	k, v, err := parseEntry(line)
-	if err != nil || k != key {
-		return "", fmt.Errorf("corrupted data at offset %d", location.Offset)
+	k, v, deleted, err := parseEntry(line)
+	if err != nil || k != key || deleted {
+		return "", fmt.Errorf("%w: bad record at offset %d", ErrCorrupt, location.Offset)
 	}
 
 	return v, nil
@@ -174,15 +229,67 @@ func (s *V4IdxStore) Update(key, value string) error {
 	return s.Set(key, value)
 }
 
-// Deletes a key-value pair in the database by appending a tombstone record (`null` value) to the file
+// Deletes a key-value pair in the database by appending a tombstone record (the key without a value) to the file
 func (s *V4IdxStore) Delete(key string) error {
-	return s.Set(key, tombstoneValue)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	return s.set(key, "", true)
+}
+
+// Writes the pair only if the key has no index entry, returns false if it has one
+func (s *V4IdxStore) SetIfAbsent(key, value string) (bool, error) {
+	return s.setIf(key, value, false, func(current string, found bool) bool { return !found })
+}
+
+// Reads the record at the key's index location and appends newValue if it holds oldValue
+func (s *V4IdxStore) CompareAndSwap(key, oldValue, newValue string) (bool, error) {
+	return s.setIf(key, newValue, false, func(current string, found bool) bool { return found && current == oldValue })
+}
+
+// Appends a tombstone, dropping the index entry, only when the indexed value equals value
+func (s *V4IdxStore) DeleteIfEquals(key, value string) (bool, error) {
+	return s.setIf(key, "", true, func(current string, found bool) bool { return found && current == value })
+}
+
+// Checks cond against the indexed value before writing, the index can't change in between since
+// both happen under the write lock
+func (s *V4IdxStore) setIf(key, value string, deleted bool, cond func(current string, found bool) bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false, ErrClosed
+	}
+
+	seg, location, err := s.locate(key)
+	var current string
+	if err == nil {
+		current, err = readEntry(seg, location, key)
+	}
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return false, err
+	}
+	if !cond(current, err == nil) {
+		return false, nil
+	}
+	if err := s.set(key, value, deleted); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
 func (s *V4IdxStore) indexUpdateListener() {
 	for update := range s.manager.IndexUpdateCh {
 		s.mu.Lock()
 		for key, offset := range update.NewOffsets {
+			// The key was written again (or deleted) while the segment was being compacted
+			if loc, exists := s.index[key]; !exists || loc.SegmentId != update.SegmentId {
+				continue
+			}
 			s.index[key] = SegmentLocation{
 				SegmentId:	update.SegmentId,
 				Offset:			offset,
@@ -203,7 +310,7 @@ func (s *V4IdxStore) rebuildGlobalIndex() error {
 
 		for _, entry := range entries {
 			// Older segments might have KV pairs that have been deleted in newer ones
-			if entry.Value == tombstoneValue {
+			if entry.Deleted {
         delete(s.index, entry.Key) // Remove from index if tombstone
         continue
     	}
@@ -217,11 +324,20 @@ func (s *V4IdxStore) rebuildGlobalIndex() error {
 	return nil
 }
 
-// "key:value\n" parser
-func parseEntry(line string) (key, value string, err error) {
-	parts := strings.SplitN(strings.TrimSpace(line), ":", 2)
-	if len(parts) != 2 {
-		return "", "", fmt.Errorf("invalid entry format")
+// Values are "key:value\n" records, a tombstone is "key\n"
+func formatEntry(key, value string, deleted bool) string {
+	if deleted {
+		return key + "\n"
+	}
+	return key + ":" + value + "\n"
+}
+
+// Parser for the records written by formatEntry
+func parseEntry(line string) (key, value string, deleted bool, err error) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return "", "", false, fmt.Errorf("invalid entry format")
 	}
-	return parts[0], parts[1], nil
+	key, value, isPut := strings.Cut(line, ":")
+	return key, value, !isPut, nil
 }
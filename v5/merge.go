@@ -85,20 +85,20 @@ func (sm *SegmentManager) performMerge(level int, segments []*Segment) (*Segment
 	// Deduplicates and merges the data
 	// Tombstones act as a "shield" in upper tiers, they block us from going down a tier 
 	// to search for a missing key. This wont be a problem in v6 when we add bloom filters
-	mergedData := make(map[string]string)
+	mergedData := make(map[string]SegmentEntry)
 	for _, seg := range segments {
 		entries, err := seg.ReadAllEntries()
 		if err != nil {
 			return nil, fmt.Errorf("could not read entries from segment %d: %w", seg.Id, err)
 		}
 		for _, entry := range entries {
-			isTombstone := entry.Value == TOMBSTONE_VALUE
+			isTombstone := entry.Kind == KindDelete
 		
 			// Keep tombstones unless we are merging max level segments
 			if isMaxLevel && isTombstone {
 				delete(mergedData, entry.Key)
 			} else {
-				mergedData[entry.Key] = entry.Value
+				mergedData[entry.Key] = entry
 			}
 		}
 	}
@@ -11,17 +11,25 @@ import (
 	"sync"
 )
 
+// Record kinds. Puts are "key:value" lines, tombstones are just the key with no ":"
+const (
+	KindPut			byte = 0
+	KindDelete	byte = 1
+)
+
 type Segment struct {
 	Id			int
 	Path		string
 	DataDir	string
 	Index		map[string]int64
+	Legacy	bool	// Written before tombstone records existed, its "null" values are deletes
 	mu			sync.RWMutex
 }
 
 type SegmentEntry struct {
 	Key		 	string
 	Value 	string
+	Kind		byte
 	Offset	int64
 }
 
@@ -55,7 +63,7 @@ func (seg *Segment) SetReadOnly() error {
 	return os.Chmod(seg.Path, 0o444)
 }
 
-func (seg *Segment) Append(key, value string) error {
+func (seg *Segment) Append(key, value string, kind byte) error {
 	offset, err := seg.Size()
 	if err != nil {
 		return err
@@ -67,8 +75,7 @@ func (seg *Segment) Append(key, value string) error {
 	}
 	defer file.Close()
 
-	line := fmt.Sprintf("%s:%s\n", key, value)
-	if _, err = file.WriteString(line); err != nil {
+	if _, err = file.WriteString(formatRecord(key, value, kind)); err != nil {
 		return err
 	}
 
@@ -80,7 +87,7 @@ func (seg *Segment) Append(key, value string) error {
 }
 
 // WriteRecords writes a new segment file (used in compaction)
-func (seg *Segment) WriteRecords(records map[string]string) (map[string]int64, error) {
+func (seg *Segment) WriteRecords(records map[string]SegmentEntry) (map[string]int64, error) {
 	tempPath := seg.Path + ".tmp"
 	tempFile, err := os.Create(tempPath)
 	if err != nil {
@@ -92,9 +99,9 @@ func (seg *Segment) WriteRecords(records map[string]string) (map[string]int64, e
 	var offset int64 = 0
 
 	// Write compacted records to temp file and keep track of new offsets
-	for key, value := range records {
+	for key, record := range records {
 		newOffsets[key] = offset
-		line := fmt.Sprintf("%s:%s\n", key, value)
+		line := formatRecord(key, record.Value, record.Kind)
 
 		if _, err := tempFile.WriteString(line); err != nil {
 			tempFile.Close()
@@ -136,10 +143,11 @@ func (seg *Segment) ReadAllEntries() ([]SegmentEntry, error) {
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
 		line := scanner.Text()
-		if k, v, err := parseEntry(line); err == nil {
+		if k, v, kind, err := seg.parseRecord(line); err == nil {
 			entries = append(entries, SegmentEntry{
 				Key: 		k,
 				Value: 	v,
+				Kind:		kind,
 				Offset: offset,
 			})
 		}
@@ -170,28 +178,38 @@ func (seg *Segment) Read(offset int64) (string, error) {
 	return strings.TrimSpace(line), nil // Returning the line without the newline char
 }
 
-func (seg *Segment) LookupKey(key string) (string, bool) {
+// Returns the value and kind for the key, a tombstone is found with KindDelete
+func (seg *Segment) LookupKey(key string) (string, byte, bool) {
 	seg.mu.RLock()
 	offset, found := seg.Index[key]
 	seg.mu.RUnlock()
 
 	if !found {
-		return "", false
+		return "", 0, false
 	}
 
 	// Call line reader on the expected offset
 	line, err := seg.Read(offset)
 	if err != nil {
-		return "", false
+		return "", 0, false
 	}
 
 	// Make sure it matches the expected key
-	k, v, err := parseEntry(line)
+	k, v, kind, err := seg.parseRecord(line)
 	if err != nil || k != key {
-		return "", false
+		return "", 0, false
 	}
 
-	return v, true
+	return v, kind, true
+}
+
+// Parses a line of this segment, legacy segments still use "null" as their tombstone
+func (seg *Segment) parseRecord(line string) (key, value string, kind byte, err error) {
+	key, value, kind, err = parseRecord(line)
+	if err == nil && seg.Legacy && kind == KindPut && value == legacyTombstoneValue {
+		return key, "", KindDelete, nil
+	}
+	return key, value, kind, err
 }
 
 // ═════════════════════════════════════════════════════
@@ -9,10 +9,15 @@ import (
 	"sync"
 )
 
+// Manifests without a version were written before tombstone records existed
+const manifestVersion = 1
+
 type Manifest struct {
-	Tiers					[]ManifestTier	`json:"tiers"`
-	ActiveSegment	string					`json:"active_segment"`
-	NextEntryID		int							`json:"next_entry_id"`
+	Version					int							`json:"version"`
+	Tiers						[]ManifestTier	`json:"tiers"`
+	ActiveSegment		string					`json:"active_segment"`
+	NextEntryID			int							`json:"next_entry_id"`
+	LegacySegments	[]string				`json:"legacy_segments,omitempty"` // Segments that still use "null" tombstones
 }
 
 type ManifestTier struct {
@@ -43,13 +48,13 @@ type SegmentManager struct {
 	mergerDone			sync.WaitGroup
 }
 
-func NewSegmentManager(dataDir string) *SegmentManager {
+func NewSegmentManager(dataDir string, opts Options) *SegmentManager {
 	sm := &SegmentManager{
 		dataDir:        dataDir,
 		mergeCh:      	make(chan []*Segment, 10), // Up to 10 segments can be queued for compaction
 		stopMerger:			make(chan struct{}),
-		mergeThreshold:	4, // Merge when Tier 0 has 4 segments
-		maxLevels: 			MAX_LEVEL,
+		mergeThreshold:	opts.MergeThreshold,
+		maxLevels: 			opts.MaxLevels,
 	}
 	
 	sm.mergerDone.Add(1)
@@ -64,8 +69,8 @@ func (sm *SegmentManager) Close() {
 }
 
 // Get searches for a key in all older segments
-// It returns (value, found)
-func (sm *SegmentManager) Get(key string) (string, bool) {
+// It returns (value, kind, found), a tombstone is found with KindDelete
+func (sm *SegmentManager) Get(key string) (string, byte, bool) {
 	sm.mu.RLock()
 	defer sm.mu.RUnlock()
 
@@ -77,13 +82,13 @@ func (sm *SegmentManager) Get(key string) (string, bool) {
 		// Newest (LAST) -> Oldest (FIRST)
 		for i := len(tier.Segments) - 1; i >= 0; i-- {
 			seg := tier.Segments[i]
-			val, found := seg.LookupKey(key)
+			val, kind, found := seg.LookupKey(key)
 			if found {
-				return val, true
+				return val, kind, true
 			}
 		}
 	}
-	return "", false
+	return "", 0, false
 }
 
 // Loads the db structure from the MANIFEST file or initializes a new one
@@ -101,10 +106,17 @@ func (sm *SegmentManager) InitState() (*Segment, error) {
 	// It exists so we error out
 	var manifest Manifest
 	if err := json.NewDecoder(f).Decode(&manifest); err != nil {
-		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+		return nil, fmt.Errorf("%w: failed to parse manifest: %v", ErrCorrupt, err)
 	}
 
 	sm.nextEntryID = manifest.NextEntryID
+
+	// Every segment of an unversioned manifest is legacy, newer ones list them
+	legacy := make(map[string]bool)
+	for _, segName := range manifest.LegacySegments {
+		legacy[segName] = true
+	}
+	allLegacy := manifest.Version < manifestVersion
 	
 	validFiles := make(map[string]bool)
 
@@ -114,6 +126,7 @@ func (sm *SegmentManager) InitState() (*Segment, error) {
 		for _, segName := range mt.Segments {
 			id, _ := parseSegmentID(segName)
 			seg := NewSegment(sm.dataDir, id)
+			seg.Legacy = allLegacy || legacy[segName]
 			tierSegments = append(tierSegments, seg)
 			validFiles[segName] = true
 		}
@@ -129,6 +142,7 @@ func (sm *SegmentManager) InitState() (*Segment, error) {
 	if manifest.ActiveSegment != "" {
 		id, _ := parseSegmentID(manifest.ActiveSegment)
 		sm.activeSegment = NewSegment(sm.dataDir, id)
+		sm.activeSegment.Legacy = allLegacy || legacy[manifest.ActiveSegment]
 		validFiles[manifest.ActiveSegment] = true
 	}
 
@@ -147,6 +161,11 @@ func (sm *SegmentManager) initializeFromDirectory() (*Segment, error) {
 		return nil, nil
 	}
 
+	// Segments without a manifest come from an older version
+	for _, seg := range segments {
+		seg.Legacy = true
+	}
+
 	// Assign the last segment as active and add everything else to tierSegments
 	sm.activeSegment = segments[len(segments)-1]
 	tierSegments := segments[:len(segments)-1]
@@ -200,8 +219,12 @@ func (sm *SegmentManager) cleanupDirectory(validFiles map[string]bool) {
 // Builds a manifest format from the one SegmentManager has in memory
 func (sm *SegmentManager) buildManifestFromState() Manifest {
 	manifest := Manifest{
-		ActiveSegment: filepath.Base(sm.activeSegment.Path),
-		NextEntryID:	 sm.nextEntryID,
+		Version:				manifestVersion,
+		ActiveSegment:	filepath.Base(sm.activeSegment.Path),
+		NextEntryID:		sm.nextEntryID,
+	}
+	if sm.activeSegment.Legacy {
+		manifest.LegacySegments = append(manifest.LegacySegments, manifest.ActiveSegment)
 	}
 
 	// TODO: This feels like the same we are doing in InitState but optimized,
@@ -210,6 +233,9 @@ func (sm *SegmentManager) buildManifestFromState() Manifest {
 		mt := ManifestTier{Level: tier.Level}
 		for _, seg := range tier.Segments {
 			mt.Segments = append(mt.Segments, filepath.Base(seg.Path))
+			if seg.Legacy {
+				manifest.LegacySegments = append(manifest.LegacySegments, filepath.Base(seg.Path))
+			}
 		}
 		manifest.Tiers = append(manifest.Tiers, mt)
 	}
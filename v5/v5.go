@@ -1,42 +1,91 @@
 package v5
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+
+	"kv-store/kverrors"
 )
 
-const TOMBSTONE_VALUE = "null"
+// Segments written before tombstone records existed used this value for deletes
+const legacyTombstoneValue = "null"
 const MAX_LEVEL = 2
 
+// Open returns ErrCorrupt when the manifest can't be parsed
+var (
+	ErrNotFound	= kverrors.ErrNotFound
+	ErrCorrupt	= kverrors.ErrCorrupt
+	ErrClosed		= kverrors.ErrClosed
+)
+
+// Tunables for Open, zero fields get the default value
+type Options struct {
+	MaxSegmentSize	int64	// Bytes before the active segment is rotated
+	MaxLevels				int		// Index of the last tier, tombstones are dropped when merging into it
+	MergeThreshold	int		// Segments in a tier before they are merged into the next one
+}
+
+func DefaultOptions() Options {
+	return Options{
+		MaxSegmentSize:	75, // Small max size ~8 lines
+		MaxLevels:			MAX_LEVEL,
+		MergeThreshold:	4, // Merge when Tier 0 has 4 segments
+	}
+}
+
+// Fills the zero fields with the defaults
+func (o Options) withDefaults() Options {
+	def := DefaultOptions()
+	if o.MaxSegmentSize <= 0 {
+		o.MaxSegmentSize = def.MaxSegmentSize
+	}
+	if o.MaxLevels <= 0 {
+		o.MaxLevels = def.MaxLevels
+	}
+	if o.MergeThreshold < 2 {
+		o.MergeThreshold = def.MergeThreshold
+	}
+	return o
+}
+
 type V5Store struct {
 	mu             sync.RWMutex
 	dataDir        string
 	activeSegment  *Segment
 	maxSegmentSize int64
 	manager        *SegmentManager
+	closed         bool
 }
 
-func NewV5Store() *V5Store {
-	dataDir := filepath.Join("v5", "data")
+func NewV5Store() (*V5Store, error) {
+	return Open(filepath.Join("v5", "data"), DefaultOptions())
+}
+
+// Opens (or creates) a store in dir
+func Open(dataDir string, opts Options) (*V5Store, error) {
+	opts = opts.withDefaults()
 	if err := os.MkdirAll(dataDir, 0755); err != nil {
-    panic(fmt.Sprintf("failed to create data directory: %v", err))
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
 	}
 
-	manager := NewSegmentManager(dataDir)
+	manager := NewSegmentManager(dataDir, opts)
 
 	activeSegment, err := manager.InitState()
 	if err != nil {
-		panic(fmt.Sprintf("failed to initialize db state: %v", err))
+		manager.Close()
+		return nil, fmt.Errorf("failed to initialize db state: %w", err)
 	}
 
 	// If theres no existing segments we create an empty segment file and a manifest file
 	if activeSegment == nil {
 		activeSegment, err = manager.CreateSegment()
 		if err != nil {
-			panic(fmt.Sprintf("failed to create initial segment: %v", err))
+			manager.Close()
+			return nil, fmt.Errorf("failed to create initial segment: %w", err)
 		}
 		manager.WriteInitialManifest(activeSegment)
 	}
@@ -49,15 +98,33 @@ func NewV5Store() *V5Store {
 		}
 	}
 
+	// A legacy active segment can't take new records, a "null" value would read as a delete
+	if activeSegment.Legacy {
+		activeSegment.RebuildIndex()
+		activeSegment, err = manager.RotateSegment(activeSegment)
+		if err != nil {
+			manager.Close()
+			return nil, fmt.Errorf("failed to rotate legacy segment: %w", err)
+		}
+	}
+
 	return &V5Store{
 		dataDir:        dataDir,
-		maxSegmentSize:	75, // Small max size ~8 lines
+		maxSegmentSize:	opts.MaxSegmentSize,
 		manager:        manager,
 		activeSegment:  activeSegment,
-	}
+	}, nil
 }
 
 func (s *V5Store) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+
 	s.manager.Close()
 	return nil
 }
@@ -68,10 +135,18 @@ func (s *V5Store) Set(key, value string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.closed {
+		return ErrClosed
+	}
+	return s.set(key, value, KindPut)
+}
+
+// Expects s.mu to be locked
+func (s *V5Store) set(key, value string, kind byte) error {
 	currentSize, _ := s.activeSegment.Size()
 	
-	// Write size of the new KV pair
-	writeSize := int64(len(key) + len(value) + 2) // key:value\n, the +2 is for ":" and "\n"
+	// Write size of the new record
+	writeSize := int64(len(formatRecord(key, value, kind)))
 
 	// If current size + new pair is bigger than max, rotate the segment
 	if currentSize + writeSize >= s.maxSegmentSize {
@@ -87,30 +162,38 @@ func (s *V5Store) Set(key, value string) error {
 		s.activeSegment = newSegment
 	}
 
-	return s.activeSegment.Append(key, value)
+	return s.activeSegment.Append(key, value, kind)
 }
 
 func (s *V5Store) Get(key string) (string, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
+	if s.closed {
+		return "", ErrClosed
+	}
+	return s.get(key)
+}
+
+// Expects s.mu to be locked (read or write)
+func (s *V5Store) get(key string) (string, error) {
 	// Check active segment first
-	if value, found := s.activeSegment.LookupKey(key); found {
-		if value == TOMBSTONE_VALUE {
-			return "", fmt.Errorf("key not found: %s", key)
+	if value, kind, found := s.activeSegment.LookupKey(key); found {
+		if kind == KindDelete {
+			return "", fmt.Errorf("%w: %s", ErrNotFound, key)
 		}
 		return value, nil
 	}
 
 	// Check older segments through the segment manager
-	if value, found := s.manager.Get(key); found {
-		if value == TOMBSTONE_VALUE {
-			return "", fmt.Errorf("key not found: %s", key)
+	if value, kind, found := s.manager.Get(key); found {
+		if kind == KindDelete {
+			return "", fmt.Errorf("%w: %s", ErrNotFound, key)
 		}
 		return value, nil
 	}
 
-	return "", fmt.Errorf("key not found: %s", key)
+	return "", fmt.Errorf("%w: %s", ErrNotFound, key)
 }
 
 // Updates a key-value pair in the database by appending an updated value to the file
@@ -118,16 +201,72 @@ func (s *V5Store) Update(key, value string) error {
 	return s.Set(key, value)
 }
 
-// Deletes a key-value pair in the database by appending a tombstone record (`null` value) to the file
+// Deletes a key-value pair in the database by appending a tombstone record to the file
 func (s *V5Store) Delete(key string) error {
-	return s.Set(key, TOMBSTONE_VALUE)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	return s.set(key, "", KindDelete)
+}
+
+// Appends a put record unless the key has a live value in the active segment or the tiers
+func (s *V5Store) SetIfAbsent(key, value string) (bool, error) {
+	return s.setIf(key, value, KindPut, func(current string, found bool) bool { return !found })
+}
+
+// Appends a put with newValue if the current value is oldValue, a missing or deleted key never matches
+func (s *V5Store) CompareAndSwap(key, oldValue, newValue string) (bool, error) {
+	return s.setIf(key, newValue, KindPut, func(current string, found bool) bool { return found && current == oldValue })
+}
+
+// Appends a KindDelete record if the current value is still value
+func (s *V5Store) DeleteIfEquals(key, value string) (bool, error) {
+	return s.setIf(key, "", KindDelete, func(current string, found bool) bool { return found && current == value })
+}
+
+// Looks the key up and appends a record of kind while holding the write lock
+// Returns false without writing if cond doesn't hold
+func (s *V5Store) setIf(key, value string, kind byte, cond func(current string, found bool) bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false, ErrClosed
+	}
+
+	current, err := s.get(key)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return false, err
+	}
+	if !cond(current, err == nil) {
+		return false, nil
+	}
+	if err := s.set(key, value, kind); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// "key:value\n" for puts, "key\n" for tombstones
+func formatRecord(key, value string, kind byte) string {
+	if kind == KindDelete {
+		return key + "\n"
+	}
+	return key + ":" + value + "\n"
 }
 
-// "key:value\n" parser
-func parseEntry(line string) (key, value string, err error) {
-	parts := strings.SplitN(strings.TrimSpace(line), ":", 2)
-	if len(parts) != 2 {
-		return "", "", fmt.Errorf("invalid entry format")
+// Parses the lines written by formatRecord
+func parseRecord(line string) (key, value string, kind byte, err error) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return "", "", 0, fmt.Errorf("invalid entry format")
+	}
+	key, value, isPut := strings.Cut(line, ":")
+	if !isPut {
+		return key, "", KindDelete, nil
 	}
-	return parts[0], parts[1], nil
+	return key, value, KindPut, nil
 }
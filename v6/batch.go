@@ -0,0 +1,34 @@
+package v6
+
+// Group of puts and deletes applied atomically by V6Store.Write
+// The batch is a single WAL entry, after a crash either every operation is replayed or none is
+//
+//	b := NewWriteBatch()
+//	b.Put("balance:alice", "90")
+//	b.Put("balance:bob", "110")
+//	err := store.Write(b)
+type WriteBatch struct {
+	ops	[]kvEntry
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+func (b *WriteBatch) Put(key, value string) {
+	b.ops = append(b.ops, kvEntry{Key: []byte(key), Value: []byte(value), Kind: KindPut})
+}
+
+func (b *WriteBatch) Delete(key string) {
+	b.ops = append(b.ops, kvEntry{Key: []byte(key), Kind: KindDelete})
+}
+
+// Number of operations in the batch
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+// Empties the batch so it can be reused
+func (b *WriteBatch) Reset() {
+	b.ops = b.ops[:0]
+}
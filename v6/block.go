@@ -0,0 +1,156 @@
+package v6
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// SST2 data block, before compression: [records][restart offset uint32 per restart point][restart count uint32]
+//
+// Sorted keys share long prefixes, so a record only stores the bytes that differ from the
+// previous key: [kind][seq uvarint][expiresAt uvarint][shared uvarint][unsharedLen uvarint][valueLen uvarint][unshared key][value]
+// Every Nth record is a restart point with the whole key (shared = 0). A read binary searches
+// the restart points and decodes forward from there, so it never starts at the top of the block
+func appendPrefixRecord(dst []byte, entry kvEntry, shared int) []byte {
+	dst = append(dst, entry.Kind)
+	dst = binary.AppendUvarint(dst, entry.Seq)
+	dst = binary.AppendUvarint(dst, uint64(entry.ExpiresAt))
+	dst = binary.AppendUvarint(dst, uint64(shared))
+	dst = binary.AppendUvarint(dst, uint64(len(entry.Key)-shared))
+	dst = binary.AppendUvarint(dst, uint64(len(entry.Value)))
+	dst = append(dst, entry.Key[shared:]...)
+	return append(dst, entry.Value...)
+}
+
+func sharedPrefixLen(a, b []byte) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// Records of one block, or of the span between two index entries for SST1 tables
+type blockRecords struct {
+	reader		*bufio.Reader	// SST1 tables, read with readRecord
+	data			[]byte				// Records, without the restart points
+	restarts	[]byte				// Restart offsets, 4 bytes each
+	pos				int
+	key				[]byte				// Key of the previous record, the next one shares a prefix with it
+}
+
+// Splits a verified block in records and restart points
+func newPrefixBlock(block []byte) (*blockRecords, error) {
+	if len(block) < 4 {
+		return nil, fmt.Errorf("block is too short")
+	}
+	count := int(binary.BigEndian.Uint32(block[len(block)-4:]))
+	if count == 0 || count > (len(block)-4)/4 {
+		return nil, fmt.Errorf("invalid restart count %d", count)
+	}
+	end := len(block) - 4 - 4*count
+	return &blockRecords{data: block[:end], restarts: block[end : len(block)-4]}, nil
+}
+
+type prefixHeader struct {
+	kind			byte
+	seq				uint64
+	expiresAt	uint64
+	shared		uint64
+	unshared	uint64
+	valueLen	uint64
+	keyStart	int			// Offset of the unshared key bytes in the block
+}
+
+// Decodes the header of the record at pos
+func (b *blockRecords) header(pos int) (prefixHeader, error) {
+	var h prefixHeader
+	if pos >= len(b.data) {
+		return h, io.ErrUnexpectedEOF
+	}
+	h.kind = b.data[pos]
+	n := pos + 1
+	for _, field := range []*uint64{&h.seq, &h.expiresAt, &h.shared, &h.unshared, &h.valueLen} {
+		v, size := binary.Uvarint(b.data[n:])
+		if size <= 0 {
+			return h, io.ErrUnexpectedEOF
+		}
+		*field = v
+		n += size
+	}
+	if h.unshared+h.valueLen > uint64(len(b.data)-n) {
+		return h, io.ErrUnexpectedEOF
+	}
+	h.keyStart = n
+	return h, nil
+}
+
+// Next record, io.EOF at the end of the block. The entry doesn't point into the
+// block, cached blocks are shared
+func (b *blockRecords) next() (kvEntry, error) {
+	if b.pos >= len(b.data) {
+		return kvEntry{}, io.EOF
+	}
+	h, err := b.header(b.pos)
+	if err != nil {
+		return kvEntry{}, err
+	}
+	if h.shared > uint64(len(b.key)) {
+		return kvEntry{}, fmt.Errorf("key shares %d bytes with a %d byte key", h.shared, len(b.key))
+	}
+
+	keyLen := h.shared + h.unshared
+	end := h.keyStart + int(h.unshared+h.valueLen)
+	buf := make([]byte, keyLen+h.valueLen)
+	copy(buf, b.key[:h.shared])
+	copy(buf[h.shared:], b.data[h.keyStart:end])
+
+	b.key = buf[:keyLen]
+	b.pos = end
+	return kvEntry{Key: buf[:keyLen], Value: buf[keyLen:], Kind: h.kind, Seq: h.seq, ExpiresAt: int64(h.expiresAt)}, nil
+}
+
+// Key of restart point i, restart points store the whole key
+func (b *blockRecords) restartKey(i int) ([]byte, error) {
+	pos := int(binary.BigEndian.Uint32(b.restarts[4*i:]))
+	h, err := b.header(pos)
+	if err != nil {
+		return nil, err
+	}
+	if h.shared != 0 {
+		return nil, fmt.Errorf("restart point at %d shares %d bytes", pos, h.shared)
+	}
+	return b.data[h.keyStart : h.keyStart+int(h.unshared)], nil
+}
+
+// Moves to the last restart point with a key < key, the first version of key can't be
+// before it. Blocks without restart points are read from the start
+func (b *blockRecords) seek(key []byte) error {
+	count := len(b.restarts) / 4
+	if b.reader != nil || count == 0 {
+		return nil
+	}
+
+	var err error
+	i := sort.Search(count, func(i int) bool {
+		restart, e := b.restartKey(i)
+		if e != nil {
+			err = e
+			return true
+		}
+		return bytes.Compare(restart, key) >= 0
+	})
+	if err != nil {
+		return err
+	}
+	if i > 0 {
+		i--
+	}
+	b.pos = int(binary.BigEndian.Uint32(b.restarts[4*i:]))
+	b.key = nil
+	return nil
+}
@@ -1,15 +1,26 @@
 package v6
 
 import (
-	"hash/fnv"
+	"encoding/binary"
 	"math"
 )
 
+// Hash of a filter, the format of the table it's in picks it. SST1 filters hash with two 32-bit
+// FNV-1a hashes and plain double hashing, they're still read that way. SST2 filters use one
+// xxhash64 and enhanced double hashing
+type bloomHash byte
+
+const (
+	bloomHashFNV bloomHash = iota
+	bloomHashXX
+)
+
 type BloomFilter struct {
 	bits			[]byte
 	numBits		uint32
 	numHashes	uint32
 	numItems	uint32
+	hash			bloomHash
 }
 
 func NewBloomFilter(n int, fpRate float64) *BloomFilter {
@@ -28,55 +39,104 @@ func NewBloomFilter(n int, fpRate float64) *BloomFilter {
 		numBits:		numBits,
 		numHashes:	numHashes,
 		numItems:		0,
+		hash:				bloomHashXX,
+	}
+}
+
+// Sized by bits per key instead of a target false positive rate
+func NewBloomFilterBitsPerKey(n int, bitsPerKey int) *BloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	numBits := uint32(n * bitsPerKey)
+
+	// optimal num of hash functions = bits per key * ln(2)
+	numHashes := uint32(math.Round(float64(bitsPerKey) * math.Log(2)))
+	if numHashes == 0 {
+		numHashes = 1
+	}
+
+	return &BloomFilter{
+		bits:				make([]byte, (numBits + 7) / 8),
+		numBits:		numBits,
+		numHashes:	numHashes,
+		numItems:		0,
+		hash:				bloomHashXX,
 	}
 }
 
 // Inserts key into the filter
 func (bf *BloomFilter) Add(key []byte) {
-	h1, h2 := bf.hash(key)
-	
-	for i := uint32(0); i < bf.numHashes; i++ {
-		// Double hashing: hash_i(x) = hash1(x) + i * hash2(x)
-		pos := (h1 + i*h2) % bf.numBits
-		bf.setBit(pos)
-	}
-	
+	bf.probe(key, true)
 	bf.numItems++
 }
 
 // TRUE if key MIGHT be present (can be false positive)
 // FALSE if key is NOT present
 func (bf *BloomFilter) MayContain(key []byte) bool {
-	h1, h2 := bf.hash(key)
-	
+	return bf.probe(key, false)
+}
+
+// Sets (or checks) the numHashes bits of key, false at the first unset bit
+func (bf *BloomFilter) probe(key []byte, set bool) bool {
+	if bf.numBits == 0 {
+		return true
+	}
+
+	if bf.hash == bloomHashFNV {
+		h1, h2 := fnvHashes(key)
+		for i := uint32(0); i < bf.numHashes; i++ {
+			// Double hashing: hash_i(x) = hash1(x) + i * hash2(x)
+			pos := (h1 + i*h2) % bf.numBits
+			if set {
+				bf.setBit(pos)
+			} else if !bf.getBit(pos) {
+				return false
+			}
+		}
+		return true
+	}
+
+	// Enhanced double hashing: the step grows by i every probe, so two keys with the same
+	// first two positions don't share all the others
+	m := uint64(bf.numBits)
+	h := xxhash64(key)
+	// Lower and upper halves, h % m and rotated h % m are related and give ~2x the false positives
+	x := uint64(uint32(h)) % m
+	y := (h >> 32) % m
 	for i := uint32(0); i < bf.numHashes; i++ {
-		pos := (h1 + i*h2) % bf.numBits
-		if !bf.getBit(pos) {
+		pos := uint32(x)
+		if set {
+			bf.setBit(pos)
+		} else if !bf.getBit(pos) {
 			return false
 		}
+		x = (x + y) % m
+		y = (y + uint64(i)) % m
 	}
-	
 	return true
 }
 
-func (bf *BloomFilter) hash(key []byte) (uint32, uint32) {
-	// First hash: FNV-1a
-	h1 := fnv.New32a()
-	h1.Write(key)
-	hash1 := h1.Sum32()
-	
-	// Second hash: FNV-1a with different seed
-	h2 := fnv.New32a()
-	seed := []byte{0xde, 0xad, 0xbe, 0xef}
-	h2.Write(seed)
-	h2.Write(key)
-	hash2 := h2.Sum32()
-	
+// FNV-1a of key and of 0xdeadbeef+key, the hashes of SST1 filters
+func fnvHashes(key []byte) (uint32, uint32) {
+	const offset32, prime32 = 2166136261, 16777619
+	hash1 := uint32(offset32)
+	for _, c := range key {
+		hash1 = (hash1 ^ uint32(c)) * prime32
+	}
+
+	hash2 := uint32(offset32)
+	for _, c := range [4]byte{0xde, 0xad, 0xbe, 0xef} {
+		hash2 = (hash2 ^ uint32(c)) * prime32
+	}
+	for _, c := range key {
+		hash2 = (hash2 ^ uint32(c)) * prime32
+	}
+
 	// Ensure hash2 is odd (for better distribution with double hashing)
 	if hash2%2 == 0 {
 		hash2++
 	}
-	
 	return hash1, hash2
 }
 
@@ -121,44 +181,36 @@ func (bf *BloomFilter) EstimatedFPR() float64 {
 func (bf *BloomFilter) Marshal() []byte {
 	// Format: [numBits:4][numHashes:4][numItems:4][bits...]
 	result := make([]byte, 12+len(bf.bits))
-	
-	result[0] = byte(bf.numBits >> 24)
-	result[1] = byte(bf.numBits >> 16)
-	result[2] = byte(bf.numBits >> 8)
-	result[3] = byte(bf.numBits)
-	
-	result[4] = byte(bf.numHashes >> 24)
-	result[5] = byte(bf.numHashes >> 16)
-	result[6] = byte(bf.numHashes >> 8)
-	result[7] = byte(bf.numHashes)
-	
-	result[8] = byte(bf.numItems >> 24)
-	result[9] = byte(bf.numItems >> 16)
-	result[10] = byte(bf.numItems >> 8)
-	result[11] = byte(bf.numItems)
-	
+	binary.BigEndian.PutUint32(result[0:], bf.numBits)
+	binary.BigEndian.PutUint32(result[4:], bf.numHashes)
+	binary.BigEndian.PutUint32(result[8:], bf.numItems)
 	copy(result[12:], bf.bits)
-	
+
 	return result
 }
 
-// Deserializes a Bloom filter from bytes
-func UnmarshalBloomFilter(data []byte) *BloomFilter {
+// Deserializes a Bloom filter from bytes, nil if it's too short for its bits.
+// The format doesn't store the hash, the caller knows it from the table's version
+func UnmarshalBloomFilter(data []byte, hash bloomHash) *BloomFilter {
 	if len(data) < 12 {
 		return nil
 	}
-	
-	numBits := uint32(data[0])<<24 | uint32(data[1])<<16 | uint32(data[2])<<8 | uint32(data[3])
-	numHashes := uint32(data[4])<<24 | uint32(data[5])<<16 | uint32(data[6])<<8 | uint32(data[7])
-	numItems := uint32(data[8])<<24 | uint32(data[9])<<16 | uint32(data[10])<<8 | uint32(data[11])
-	
+
+	numBits := binary.BigEndian.Uint32(data[0:])
+	numHashes := binary.BigEndian.Uint32(data[4:])
+	numItems := binary.BigEndian.Uint32(data[8:])
+	if uint64(len(data)-12) < (uint64(numBits)+7)/8 {
+		return nil
+	}
+
 	bits := make([]byte, len(data)-12)
 	copy(bits, data[12:])
-	
+
 	return &BloomFilter{
-		bits:      bits,
-		numBits:   numBits,
-		numHashes: numHashes,
-		numItems:  numItems,
+		bits:				bits,
+		numBits:		numBits,
+		numHashes:	numHashes,
+		numItems:		numItems,
+		hash:				hash,
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,102 @@
+package v6
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// Data blocks read from the SSTables, shared by every table of a store and bounded by the
+// bytes of the blocks it holds. The least recently used blocks are evicted first.
+// Blocks are only added once their checksum was verified
+type blockCache struct {
+	mu				sync.Mutex
+	capacity	int64
+	size			int64
+	lru				*list.List								// Front is the most recently used
+	blocks		map[blockKey]*list.Element
+	hits			uint64
+	misses		uint64
+}
+
+type blockKey struct {
+	table		uint64	// Unique per loaded SSTable, ids are never reused so a new table can't get old blocks
+	offset	int64
+}
+
+type cachedBlock struct {
+	key		blockKey
+	data	[]byte
+}
+
+type BlockCacheStats struct {
+	Hits			uint64
+	Misses		uint64
+	Blocks		int
+	Size			int64
+	Capacity	int64
+}
+
+// Ids for the cache keys, blocks of deleted tables are never read again and get evicted
+var nextTableID atomic.Uint64
+
+func newBlockCache(capacity int64) *blockCache {
+	return &blockCache{
+		capacity:	capacity,
+		lru:			list.New(),
+		blocks:		make(map[blockKey]*list.Element),
+	}
+}
+
+// The block data must not be modified by the caller
+func (c *blockCache) get(key blockKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.blocks[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*cachedBlock).data, true
+}
+
+func (c *blockCache) add(key blockKey, data []byte) {
+	size := int64(len(data))
+	if size > c.capacity {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Two readers can miss the same block at the same time
+	if _, ok := c.blocks[key]; ok {
+		return
+	}
+	c.blocks[key] = c.lru.PushFront(&cachedBlock{key: key, data: data})
+	c.size += size
+
+	for c.size > c.capacity {
+		oldest := c.lru.Back()
+		block := oldest.Value.(*cachedBlock)
+		c.lru.Remove(oldest)
+		delete(c.blocks, block.key)
+		c.size -= int64(len(block.data))
+	}
+}
+
+func (c *blockCache) stats() BlockCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return BlockCacheStats{
+		Hits:			c.hits,
+		Misses:		c.misses,
+		Blocks:		len(c.blocks),
+		Size:			c.size,
+		Capacity:	c.capacity,
+	}
+}
@@ -0,0 +1,154 @@
+package v6
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+)
+
+// Merges every SSTable with keys in [start, end) down to the last tier, where tombstones
+// and expired values in the range are dropped. A nil end means no upper bound.
+// Background merges are paused until it's done, the running ones it conflicts with are waited for
+func (lsm *LSMManager) compactRange(start, end []byte) error {
+	lsm.mu.Lock()
+	lsm.manualCompactions++
+	lsm.mu.Unlock()
+	defer func() {
+		lsm.mu.Lock()
+		lsm.manualCompactions--
+		lsm.mu.Unlock()
+		lsm.scheduleCompaction()
+	}()
+
+	toDelete := make([]*SSTableReader, 0)
+	defer func() {
+		for _, seg := range toDelete {
+			seg.Close()
+			os.Remove(seg.Path)
+		}
+	}()
+
+	// One merge per level, each one takes what the one before it wrote. The merge into the
+	// last tier takes every segment of it in the range, so the last tier is done after it
+	for level := 0; level <= lsm.maxLevels; level++ {
+		c, err := lsm.startManualCompaction(level, start, end)
+		if err != nil {
+			return err
+		}
+		if c == nil {
+			continue
+		}
+
+		err = lsm.runMergeCycle(c, &toDelete)
+		lsm.mu.Lock()
+		lsm.finishMerge(c, err)
+		lsm.mu.Unlock()
+		if err != nil {
+			return fmt.Errorf("failed to compact tier %d: %w", level, err)
+		}
+		if c.Target == lsm.maxLevels {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Waits until the merge of the level doesn't conflict with the running ones and adds it to
+// them. nil if the level has nothing in the range
+func (lsm *LSMManager) startManualCompaction(level int, start, end []byte) (*Compaction, error) {
+	lsm.mu.Lock()
+	defer lsm.mu.Unlock()
+
+	for {
+		if lsm.closed {
+			return nil, ErrClosed
+		}
+		c := lsm.manualCompaction(level, start, end)
+		if c == nil {
+			return nil, nil
+		}
+		if !conflictsWithAny(c, lsm.running) {
+			lsm.running = append(lsm.running, c)
+			return c, nil
+		}
+		lsm.mergeFinished.Wait()
+	}
+}
+
+// Segments of the level in the range merged with the next tier, or with itself for the
+// last one. Expects lsm.mu held
+func (lsm *LSMManager) manualCompaction(level int, start, end []byte) *Compaction {
+	if level >= len(lsm.tiers) {
+		return nil
+	}
+	inRange := func(seg *SSTableReader) bool {
+		return bytes.Compare(seg.MaxKey(), start) >= 0 && (end == nil || bytes.Compare(seg.MinKey(), end) < 0)
+	}
+	inputs := closure(lsm.tiers[level].Segments, inRange)
+	if len(inputs) == 0 {
+		return nil
+	}
+
+	target := level + 1
+	if level >= lsm.maxLevels {
+		target = lsm.maxLevels
+	}
+	c := &Compaction{
+		Level:					level,
+		Inputs:					inputs,
+		Target:					target,
+		DropTombstones:	target == lsm.maxLevels,
+	}
+
+	// Every segment of the last tier in the range too, so nothing is left for tombstones to hide
+	if target != level && target < len(lsm.tiers) {
+		inputStart, inputEnd := keyRange(inputs)
+		c.Overlaps = closure(lsm.tiers[target].Segments, func(seg *SSTableReader) bool {
+			return seg.overlaps(inputStart, inputEnd) || (target == lsm.maxLevels && inRange(seg))
+		})
+	}
+	return c
+}
+
+// The segments matching seed plus every segment whose keys overlap them, until none is left out.
+// Merging a segment without the others that share its keys could move an older version above
+// a newer one. Keeps the order of the tier
+func closure(segments []*SSTableReader, seed func(*SSTableReader) bool) []*SSTableReader {
+	picked := make([]bool, len(segments))
+	var start, end []byte
+	found := false
+	add := func(i int) {
+		seg := segments[i]
+		if !found || bytes.Compare(seg.MinKey(), start) < 0 {
+			start = seg.MinKey()
+		}
+		if !found || bytes.Compare(seg.MaxKey(), end) > 0 {
+			end = seg.MaxKey()
+		}
+		picked[i] = true
+		found = true
+	}
+
+	for i, seg := range segments {
+		if seed(seg) {
+			add(i)
+		}
+	}
+	for grown := found; grown; {
+		grown = false
+		for i, seg := range segments {
+			if !picked[i] && seg.overlaps(start, end) {
+				add(i)
+				grown = true
+			}
+		}
+	}
+
+	var result []*SSTableReader
+	for i, seg := range segments {
+		if picked[i] {
+			result = append(result, seg)
+		}
+	}
+	return result
+}
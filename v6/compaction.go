@@ -0,0 +1,302 @@
+package v6
+
+import (
+	"bytes"
+	"sort"
+)
+
+// Decides which SSTables get merged and where the output goes. Every method is
+// called with lsm.mu held, strategies can keep state between calls
+type CompactionStrategy interface {
+	Name() string
+
+	// Next merge to run, nil if every tier is within its limits or the merges left conflict
+	// with the running ones
+	Pick(tiers []Tier, running []*Compaction) *Compaction
+
+	// Levels over their limits, Pick returns a merge for one of them
+	Pending(tiers []Tier) []int
+
+	// Adds the merge output to the segments of its target tier
+	Install(segments []*SSTableReader, output *SSTableReader, level int) []*SSTableReader
+}
+
+// One merge: Inputs from Level and Overlaps from Target are merged into new SSTables of Target
+type Compaction struct {
+	Level						int
+	Inputs					[]*SSTableReader
+	Target					int
+	Overlaps				[]*SSTableReader	// Segments of the target tier whose keys overlap the inputs
+	DropTombstones	bool							// Nothing older than the merged segments is left below them
+}
+
+// Merge order, oldest first: the target tier is older than the source tier
+func (c *Compaction) segments() []*SSTableReader {
+	segments := make([]*SSTableReader, 0, len(c.Overlaps)+len(c.Inputs))
+	segments = append(segments, c.Overlaps...)
+	return append(segments, c.Inputs...)
+}
+
+// Two merges can run at the same time if they don't touch the same level or their keys
+// don't overlap. Then no key has versions in both, so the order they commit in doesn't
+// matter. A shared SSTable is always a conflict, it's in a shared level and key range
+func (c *Compaction) conflicts(other *Compaction) bool {
+	if c.Level != other.Level && c.Level != other.Target && c.Target != other.Level && c.Target != other.Target {
+		return false
+	}
+	start, end := keyRange(c.segments())
+	otherStart, otherEnd := keyRange(other.segments())
+	return bytes.Compare(start, otherEnd) <= 0 && bytes.Compare(otherStart, end) <= 0
+}
+
+func conflictsWithAny(c *Compaction, running []*Compaction) bool {
+	for _, r := range running {
+		if c.conflicts(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// SSTables the running merges are reading, they can't be picked again
+func compacting(running []*Compaction) map[int]bool {
+	busy := make(map[int]bool)
+	for _, r := range running {
+		for _, seg := range r.segments() {
+			busy[seg.Id] = true
+		}
+	}
+	return busy
+}
+
+func withoutBusy(segments []*SSTableReader, busy map[int]bool) []*SSTableReader {
+	var free []*SSTableReader
+	for _, seg := range segments {
+		if !busy[seg.Id] {
+			free = append(free, seg)
+		}
+	}
+	return free
+}
+
+func newCompactionStrategy(opts Options) CompactionStrategy {
+	if opts.CompactionStyle == Leveled {
+		return &leveledStrategy{
+			maxLevels:	opts.MaxLevels,
+			l0Trigger:	opts.MergeThreshold,
+			baseSize:		opts.LevelBaseSize,
+			multiplier:	opts.LevelSizeMultiplier,
+			cursors:		make(map[int][]byte),
+		}
+	}
+	return &sizeTieredStrategy{maxLevels: opts.MaxLevels, threshold: opts.MergeThreshold}
+}
+
+// A tier with threshold sorted runs is merged whole into the next tier.
+// The last tier merges into itself so it doesn't pile up segments
+type sizeTieredStrategy struct {
+	maxLevels	int
+	threshold	int
+}
+
+func (st *sizeTieredStrategy) Name() string {
+	return SizeTiered.String()
+}
+
+// Segments of a tier that are being merged stay out, the rest of the tier can still be
+// merged if its keys don't overlap the running merge
+func (st *sizeTieredStrategy) Pick(tiers []Tier, running []*Compaction) *Compaction {
+	busy := compacting(running)
+	for level, tier := range tiers {
+		free := withoutBusy(tier.Segments, busy)
+		if sortedRuns(free) < st.threshold {
+			continue
+		}
+
+		target := level + 1
+		if level >= st.maxLevels {
+			target = st.maxLevels
+		}
+		c := &Compaction{
+			Level:					level,
+			Inputs:					free,
+			Target:					target,
+			DropTombstones:	level >= st.maxLevels,
+		}
+		if !conflictsWithAny(c, running) {
+			return c
+		}
+	}
+	return nil
+}
+
+func (st *sizeTieredStrategy) Pending(tiers []Tier) []int {
+	var levels []int
+	for level, tier := range tiers {
+		if sortedRuns(tier.Segments) >= st.threshold {
+			levels = append(levels, level)
+		}
+	}
+	return levels
+}
+
+// The merged segments are the newest of their tier
+func (st *sizeTieredStrategy) Install(segments []*SSTableReader, output *SSTableReader, level int) []*SSTableReader {
+	return append(segments, output)
+}
+
+// L0 keeps the flushed SSTables (they overlap), every level after it has non overlapping
+// SSTables sorted by key and a size target that grows by multiplier per level.
+// The level furthest over its target gets one SSTable merged into the next level,
+// only the SSTables of that level with overlapping keys get rewritten
+type leveledStrategy struct {
+	maxLevels		int
+	l0Trigger		int
+	baseSize		int64
+	multiplier	int
+	cursors			map[int][]byte	// Max key of the last SSTable picked per level, picks go round the key space
+}
+
+func (ls *leveledStrategy) Name() string {
+	return Leveled.String()
+}
+
+func (ls *leveledStrategy) Pick(tiers []Tier, running []*Compaction) *Compaction {
+	// L0 first, it's what every read has to go through. Then the level furthest over its target
+	levels := ls.Pending(tiers)
+	sort.SliceStable(levels, func(i, j int) bool {
+		if levels[i] == 0 || levels[j] == 0 {
+			return levels[i] == 0
+		}
+		return ls.score(levels[i], tiers[levels[i]].Segments) > ls.score(levels[j], tiers[levels[j]].Segments)
+	})
+
+	busy := compacting(running)
+	for _, level := range levels {
+		if level == 0 {
+			if inputs := withoutBusy(tiers[0].Segments, busy); len(inputs) > 0 {
+				if c := ls.compaction(tiers, 0, inputs); !conflictsWithAny(c, running) {
+					return c
+				}
+			}
+			continue
+		}
+
+		// Round the key space from the cursor until a file can be merged
+		segments := tiers[level].Segments
+		first := ls.next(level, segments)
+		for i := range segments {
+			seg := segments[(first+i)%len(segments)]
+			if busy[seg.Id] {
+				continue
+			}
+			if c := ls.compaction(tiers, level, []*SSTableReader{seg}); !conflictsWithAny(c, running) {
+				ls.cursors[level] = append([]byte(nil), seg.MaxKey()...)
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// Merges the inputs with every SSTable of the next level their keys overlap
+func (ls *leveledStrategy) compaction(tiers []Tier, level int, inputs []*SSTableReader) *Compaction {
+	c := &Compaction{
+		Level:					level,
+		Inputs:					inputs,
+		Target:					level + 1,
+		DropTombstones:	level+1 >= ls.maxLevels,
+	}
+	if c.Target < len(tiers) {
+		start, end := keyRange(c.Inputs)
+		for _, seg := range tiers[c.Target].Segments {
+			if seg.overlaps(start, end) {
+				c.Overlaps = append(c.Overlaps, seg)
+			}
+		}
+	}
+	return c
+}
+
+func (ls *leveledStrategy) Pending(tiers []Tier) []int {
+	var levels []int
+	for level := 0; level < ls.maxLevels && level < len(tiers); level++ {
+		if ls.score(level, tiers[level].Segments) >= 1 {
+			levels = append(levels, level)
+		}
+	}
+	return levels
+}
+
+// >= 1 means the level needs a merge
+func (ls *leveledStrategy) score(level int, segments []*SSTableReader) float64 {
+	if level == 0 {
+		return float64(len(segments)) / float64(ls.l0Trigger)
+	}
+
+	var size int64
+	for _, seg := range segments {
+		size += seg.Size()
+	}
+	return float64(size) / float64(ls.targetSize(level))
+}
+
+func (ls *leveledStrategy) targetSize(level int) int64 {
+	size := ls.baseSize
+	for i := 1; i < level; i++ {
+		size *= int64(ls.multiplier)
+	}
+	return size
+}
+
+// Index of the first SSTable after the cursor, wraps around to the start of the level
+func (ls *leveledStrategy) next(level int, segments []*SSTableReader) int {
+	if cursor, ok := ls.cursors[level]; ok {
+		for i, seg := range segments {
+			if bytes.Compare(seg.MinKey(), cursor) > 0 {
+				return i
+			}
+		}
+	}
+	return 0
+}
+
+// L0 keeps flush order, newest last. The other levels stay sorted by key
+func (ls *leveledStrategy) Install(segments []*SSTableReader, output *SSTableReader, level int) []*SSTableReader {
+	if level == 0 {
+		return append(segments, output)
+	}
+	i := sort.Search(len(segments), func(i int) bool {
+		return bytes.Compare(segments[i].MinKey(), output.MinKey()) > 0
+	})
+	segments = append(segments, nil)
+	copy(segments[i+1:], segments[i:])
+	segments[i] = output
+	return segments
+}
+
+// A merge writes its output as several segments that follow each other without
+// overlapping, reads treat them like one segment so they count once
+func sortedRuns(segments []*SSTableReader) int {
+	runs := 0
+	for i, seg := range segments {
+		if i == 0 || bytes.Compare(seg.MinKey(), segments[i-1].MaxKey()) <= 0 {
+			runs++
+		}
+	}
+	return runs
+}
+
+// Smallest and largest key of the segments
+func keyRange(segments []*SSTableReader) ([]byte, []byte) {
+	var start, end []byte
+	for i, seg := range segments {
+		if i == 0 || bytes.Compare(seg.MinKey(), start) < 0 {
+			start = seg.MinKey()
+		}
+		if i == 0 || bytes.Compare(seg.MaxKey(), end) > 0 {
+			end = seg.MaxKey()
+		}
+	}
+	return start, end
+}
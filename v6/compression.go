@@ -0,0 +1,114 @@
+package v6
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Codec of an SSTable block, stored in the block trailer so tables written with
+// different settings, or blocks that didn't compress, can be read side by side
+type Compression byte
+
+const (
+	NoCompression Compression = iota
+
+	// In-tree LZ codec (snappy.go), cheap enough for L0 flushes
+	SnappyCompression
+
+	// compress/flate, smaller blocks for more CPU. Meant for the bottom tier, which holds
+	// most of the data and is rewritten the least often
+	DeflateCompression
+)
+
+func (c Compression) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case SnappyCompression:
+		return "snappy"
+	case DeflateCompression:
+		return "deflate"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(c))
+	}
+}
+
+// Compresses the blocks of one SSTable writer, the flate writer is reused between blocks
+// since creating one allocates a lot
+type blockCompressor struct {
+	codec		Compression
+	buf			bytes.Buffer
+	deflate	*flate.Writer
+}
+
+// Returns the codec the block was stored with and its bytes. Blocks that don't get smaller
+// are stored as they are
+func (c *blockCompressor) compress(block []byte) (Compression, []byte, error) {
+	c.buf.Reset()
+
+	switch c.codec {
+	case SnappyCompression:
+		c.buf.Write(snappyEncode(c.buf.AvailableBuffer(), block))
+	case DeflateCompression:
+		// [uncompressed length uvarint][deflate stream], the reader knows how much to allocate
+		c.buf.Write(binary.AppendUvarint(c.buf.AvailableBuffer(), uint64(len(block))))
+		if c.deflate == nil {
+			w, err := flate.NewWriter(&c.buf, flate.DefaultCompression)
+			if err != nil {
+				return 0, nil, err
+			}
+			c.deflate = w
+		} else {
+			c.deflate.Reset(&c.buf)
+		}
+		if _, err := c.deflate.Write(block); err != nil {
+			return 0, nil, err
+		}
+		if err := c.deflate.Close(); err != nil {
+			return 0, nil, err
+		}
+	default:
+		return NoCompression, block, nil
+	}
+
+	if c.buf.Len() >= len(block) {
+		return NoCompression, block, nil
+	}
+	return c.codec, c.buf.Bytes(), nil
+}
+
+// Deflate readers are reused too, reads decompress a block at a time
+var deflateReaders = sync.Pool{
+	New: func() any { return flate.NewReader(bytes.NewReader(nil)) },
+}
+
+func decompressBlock(codec Compression, data []byte) ([]byte, error) {
+	switch codec {
+	case NoCompression:
+		return data, nil
+	case SnappyCompression:
+		return snappyDecode(data)
+	case DeflateCompression:
+		n, size := binary.Uvarint(data)
+		// DEFLATE can't do better than ~1032:1
+		if size <= 0 || n > 1032*uint64(len(data)) {
+			return nil, fmt.Errorf("invalid deflate block length")
+		}
+		reader := deflateReaders.Get().(io.ReadCloser)
+		defer deflateReaders.Put(reader)
+		if err := reader.(flate.Resetter).Reset(bytes.NewReader(data[size:]), nil); err != nil {
+			return nil, err
+		}
+		block := make([]byte, n)
+		if _, err := io.ReadFull(reader, block); err != nil {
+			return nil, fmt.Errorf("deflate: %w", err)
+		}
+		return block, nil
+	default:
+		return nil, fmt.Errorf("unknown block codec %d", byte(codec))
+	}
+}
@@ -0,0 +1,108 @@
+package v6
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Writes an SSTable with the codec as its level's compression and reads every record back,
+// through Get and through an iterator
+func testSSTableCodec(t *testing.T, codec Compression) {
+	path := filepath.Join(t.TempDir(), "sst_0001.sst")
+	opts := Options{LevelCompression: []Compression{codec}}
+
+	const count = 500
+	writer, err := NewSSTableWriter(path, count, opts, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < count; i++ {
+		entry := kvEntry{
+			Key:		[]byte(fmt.Sprintf("user:%05d", i)),
+			Value:	[]byte(fmt.Sprintf("value of user %d with some padding to compress", i)),
+			Kind:		KindPut,
+			Seq:		uint64(i + 1),
+		}
+		if err := writer.Append(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Finalize(); err != nil {
+		t.Fatal(err)
+	}
+
+	table, err := LoadSSTable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close()
+
+	if len(table.index) < 2 {
+		t.Fatalf("expected several blocks, got %d", len(table.index))
+	}
+	if got := storedCodec(t, path, table.index[0]); got != codec {
+		t.Errorf("expected the first block stored with %v, got %v", codec, got)
+	}
+
+	for i := 0; i < count; i++ {
+		key := fmt.Sprintf("user:%05d", i)
+		value, kind, err := table.Get([]byte(key))
+		if err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		if want := fmt.Sprintf("value of user %d with some padding to compress", i); kind != KindPut || string(value) != want {
+			t.Fatalf("%s: expected %q, got %q (kind %d)", key, want, value, kind)
+		}
+	}
+
+	it, err := table.NewIterator(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	read := 0
+	for it.Next() {
+		if want := fmt.Sprintf("user:%05d", read); string(it.Key()) != want {
+			t.Fatalf("expected %s, got %s", want, it.Key())
+		}
+		read++
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if read != count {
+		t.Errorf("expected %d records from the iterator, got %d", count, read)
+	}
+}
+
+// Codec byte of the block's trailer
+func storedCodec(t *testing.T, path string, entry IndexEntry) Compression {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	codec := make([]byte, 1)
+	if _, err := file.ReadAt(codec, entry.Offset+entry.Size); err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	return Compression(codec[0])
+}
+
+func TestSSTableNoCompression(t *testing.T) {
+	testSSTableCodec(t, NoCompression)
+}
+
+func TestSSTableSnappyCompression(t *testing.T) {
+	testSSTableCodec(t, SnappyCompression)
+}
+
+func TestSSTableDeflateCompression(t *testing.T) {
+	testSSTableCodec(t, DeflateCompression)
+}
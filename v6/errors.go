@@ -0,0 +1,36 @@
+package v6
+
+import (
+	"errors"
+	"fmt"
+
+	"kv-store/kverrors"
+)
+
+// Checksum and decoding failures come back as a *CorruptionError matching ErrCorrupt,
+// ErrReadOnly is a write that reached a memtable after it stopped taking them
+var (
+	ErrNotFound	= kverrors.ErrNotFound
+	ErrCorrupt	= kverrors.ErrCorrupt
+	ErrClosed		= kverrors.ErrClosed
+	ErrReadOnly	= kverrors.ErrReadOnly
+)
+
+// Returned by Txn.Commit when a key the transaction read was written by someone else after it began
+var ErrConflict = errors.New("transaction conflict")
+
+// Returned when a checksum doesn't match or a file can't be decoded
+// Callers can check for it with errors.As, or errors.Is(err, ErrCorrupt)
+type CorruptionError struct {
+	Path		string
+	Offset	int64
+	Reason	string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("corruption in %s at offset %d: %s", e.Path, e.Offset, e.Reason)
+}
+
+func (e *CorruptionError) Is(target error) bool {
+	return target == ErrCorrupt
+}
@@ -0,0 +1,350 @@
+package v6
+
+import (
+	"bytes"
+	"container/heap"
+	"time"
+)
+
+// Sorted source of records used by scans, by key and then by sequence number (newest first)
+// Sources are ordered from newest to oldest so the merge knows which version wins
+// when tables without sequence numbers have the same key
+type recordIterator interface {
+	Next() bool
+	Key() []byte
+	Value() []byte
+	Kind() byte
+	Seq() uint64
+	ExpiresAt() int64
+	Err() error
+	Close() error
+}
+
+type kvEntry struct {
+	Key				[]byte
+	Value			[]byte
+	Kind			byte
+	Seq				uint64
+	ExpiresAt	int64	// Unix nanoseconds, 0 never expires
+}
+
+// An expired put hides the key like a tombstone, older versions don't come back
+func (e kvEntry) expired(now int64) bool {
+	return e.ExpiresAt != 0 && e.ExpiresAt <= now
+}
+
+// Tombstones and expired puts
+func (e kvEntry) deleted(now int64) bool {
+	return e.Kind == KindDelete || e.expired(now)
+}
+
+// Iterates over a copy of memtable entries, so we don't keep the memtable locked during a scan
+type sliceIterator struct {
+	entries	[]kvEntry
+	pos			int
+}
+
+func newSliceIterator(entries []kvEntry) *sliceIterator {
+	return &sliceIterator{entries: entries, pos: -1}
+}
+
+func (it *sliceIterator) Next() bool {
+	if it.pos < len(it.entries) {
+		it.pos++
+	}
+	return it.pos < len(it.entries)
+}
+
+func (it *sliceIterator) Key() []byte {
+	return it.entries[it.pos].Key
+}
+
+func (it *sliceIterator) Value() []byte {
+	return it.entries[it.pos].Value
+}
+
+func (it *sliceIterator) Kind() byte {
+	return it.entries[it.pos].Kind
+}
+
+func (it *sliceIterator) Seq() uint64 {
+	return it.entries[it.pos].Seq
+}
+
+func (it *sliceIterator) ExpiresAt() int64 {
+	return it.entries[it.pos].ExpiresAt
+}
+
+func (it *sliceIterator) Err() error {
+	return nil
+}
+
+func (it *sliceIterator) Close() error {
+	return nil
+}
+
+// Heap item, priority is the position of the source (lower is newer)
+type heapItem struct {
+	iter			recordIterator
+	priority	int
+}
+
+type iterHeap []*heapItem
+
+func (h iterHeap) Len() int { return len(h) }
+
+func (h iterHeap) Less(i, j int) bool {
+	cmp := bytes.Compare(h[i].iter.Key(), h[j].iter.Key())
+	if cmp != 0 {
+		return cmp < 0
+	}
+	// Same key, the newest version goes first
+	if seqI, seqJ := h[i].iter.Seq(), h[j].iter.Seq(); seqI != seqJ {
+		return seqI > seqJ
+	}
+	// Same version (old tables have no sequence numbers), the newest source goes first
+	return h[i].priority < h[j].priority
+}
+
+func (h iterHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *iterHeap) Push(x any) { *h = append(*h, x.(*heapItem)) }
+
+func (h *iterHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// K-way merge over sorted sources. When a key shows up several times only the newest
+// version visible at seq is returned, newer and older ones are skipped.
+// Tombstones and expired puts hide the key and stop at the end bound (exclusive, nil means no bound).
+type mergeIterator struct {
+	sources	[]recordIterator
+	h				iterHeap
+	end			[]byte
+	seq			uint64
+	now			int64	// Expiry is checked against the time the scan started
+	resolve	func(kvEntry) (kvEntry, error)	// Reads the values in the value log, nil leaves the pointers
+	key			[]byte
+	value		[]byte
+	err			error
+}
+
+func newMergeIterator(sources []recordIterator, end []byte, seq uint64) *mergeIterator {
+	m := &mergeIterator{sources: sources, end: end, seq: seq, now: time.Now().UnixNano()}
+	for i, src := range sources {
+		m.advance(&heapItem{iter: src, priority: i})
+	}
+	heap.Init(&m.h)
+	return m
+}
+
+// Moves a source forward and puts it back into the heap if it still has records
+func (m *mergeIterator) advance(item *heapItem) {
+	if item.iter.Next() {
+		m.h = append(m.h, item)
+		return
+	}
+	if err := item.iter.Err(); err != nil && m.err == nil {
+		m.err = err
+	}
+}
+
+func (m *mergeIterator) Next() bool {
+	for m.err == nil && m.h.Len() > 0 {
+		key := append([]byte(nil), m.h[0].iter.Key()...)
+		if m.end != nil && bytes.Compare(key, m.end) >= 0 {
+			return false
+		}
+
+		// Versions of the key come out newest first, the first one at or before seq wins
+		var entry kvEntry
+		found := false
+		for m.h.Len() > 0 && bytes.Equal(m.h[0].iter.Key(), key) {
+			top := m.h[0]
+			if !found && top.iter.Seq() <= m.seq {
+				found = true
+				entry = kvEntry{
+					Value:			append([]byte(nil), top.iter.Value()...),
+					Kind:				top.iter.Kind(),
+					ExpiresAt:	top.iter.ExpiresAt(),
+				}
+			}
+
+			if top.iter.Next() {
+				heap.Fix(&m.h, 0)
+				continue
+			}
+			heap.Pop(&m.h)
+			if err := top.iter.Err(); err != nil {
+				m.err = err
+			}
+		}
+
+		if !found || entry.deleted(m.now) {
+			continue
+		}
+		if entry.Kind == KindValuePointer && m.resolve != nil {
+			entry.Key = key
+			resolved, err := m.resolve(entry)
+			if err != nil {
+				m.err = err
+				return false
+			}
+			entry = resolved
+		}
+
+		m.key = key
+		m.value = entry.Value
+		return m.err == nil
+	}
+	return false
+}
+
+func (m *mergeIterator) Key() []byte {
+	return m.key
+}
+
+func (m *mergeIterator) Value() []byte {
+	return m.value
+}
+
+func (m *mergeIterator) Err() error {
+	return m.err
+}
+
+func (m *mergeIterator) Close() error {
+	var firstErr error
+	for _, src := range m.sources {
+		if err := src.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// K-way merge that returns every version of every key, by key and then newest first.
+// Merges use it to stream sorted SSTables into a new one, the version filter decides what's kept.
+// A version in more than one source (same key and sequence number, only tables without
+// sequence numbers) comes from the newest source
+type versionIterator struct {
+	sources	[]recordIterator
+	h				iterHeap
+	entry		kvEntry
+	started	bool
+	err			error
+}
+
+func newVersionIterator(sources []recordIterator) *versionIterator {
+	v := &versionIterator{sources: sources}
+	for i, src := range sources {
+		if src.Next() {
+			v.h = append(v.h, &heapItem{iter: src, priority: i})
+		} else if err := src.Err(); err != nil && v.err == nil {
+			v.err = err
+		}
+	}
+	heap.Init(&v.h)
+	return v
+}
+
+func (v *versionIterator) Next() bool {
+	for v.err == nil && v.h.Len() > 0 {
+		top := v.h[0]
+		// SSTable iterators read every record into a new buffer, no need to copy
+		entry := kvEntry{
+			Key:				top.iter.Key(),
+			Value:			top.iter.Value(),
+			Kind:				top.iter.Kind(),
+			Seq:				top.iter.Seq(),
+			ExpiresAt:	top.iter.ExpiresAt(),
+		}
+
+		if top.iter.Next() {
+			heap.Fix(&v.h, 0)
+		} else {
+			heap.Pop(&v.h)
+			if err := top.iter.Err(); err != nil {
+				v.err = err
+			}
+		}
+
+		if v.started && entry.Seq == v.entry.Seq && bytes.Equal(entry.Key, v.entry.Key) {
+			continue
+		}
+		v.entry = entry
+		v.started = true
+		return v.err == nil
+	}
+	return false
+}
+
+func (v *versionIterator) Entry() kvEntry {
+	return v.entry
+}
+
+func (v *versionIterator) Err() error {
+	return v.err
+}
+
+func (v *versionIterator) Close() error {
+	var firstErr error
+	for _, src := range v.sources {
+		if err := src.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Ordered iterator returned by Scan and ScanPrefix
+//
+//	it, _ := store.ScanPrefix("user:")
+//	defer it.Close()
+//	for it.Next() {
+//		fmt.Println(it.Key(), it.Value())
+//	}
+type ScanIterator struct {
+	merge		*mergeIterator
+	release	func() // Releases the snapshot the scan reads from
+}
+
+func (it *ScanIterator) Next() bool {
+	return it.merge.Next()
+}
+
+func (it *ScanIterator) Key() string {
+	return string(it.merge.Key())
+}
+
+func (it *ScanIterator) Value() string {
+	return string(it.merge.Value())
+}
+
+// Returns the first error found while reading the sources
+func (it *ScanIterator) Err() error {
+	return it.merge.Err()
+}
+
+func (it *ScanIterator) Close() error {
+	if it.release != nil {
+		it.release()
+		it.release = nil
+	}
+	return it.merge.Close()
+}
+
+// Smallest key that is bigger than every key with the given prefix
+// Returns nil if there's no such key (prefix is empty or all 0xff)
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
@@ -1,18 +1,26 @@
 package v6
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
 type Manifest struct {
 	Tiers					[]ManifestTier	`json:"tiers"`
 	ActiveWAL			string					`json:"active_wal"`
+	FlushingWAL		string					`json:"flushing_wal,omitempty"` // WAL of the memtable being flushed
 	NextEntryID		int							`json:"next_entry_id"`
+	Compaction		string					`json:"compaction,omitempty"` // Strategy that laid out the tiers, empty is size-tiered
+	LastEdit			int							`json:"last_edit,omitempty"`	// Seq of the last version edit included, see manifest_log.go
+	ValueLogs			[]string				`json:"value_logs,omitempty"`	// Files of the value log, see vlog.go
 }
 
 type ManifestTier struct {
@@ -34,36 +42,85 @@ type LSMManager struct {
 	tiers					[]Tier 		// Contains all rotated segments
 	maxLevels			int
 	nextEntryID		int
-
-	// Merging
-	mergeThreshold	int
-	mergeCh					chan []*SSTableReader
+	activeWAL			string
+	flushingWAL		string	// Kept until its SSTable is in the manifest, replayed again after a crash
+
+	// Version edits since the last MANIFEST checkpoint
+	manifestLog						*os.File
+	lastEdit							int
+	editsSinceCheckpoint	int
+
+	opts					Options
+	snapshots			*snapshotList	// Merges keep the versions live snapshots can see
+	blockCache		*blockCache		// Shared by every SSTable of the store
+	values				*valueLog			// Big values, the SSTables point to them
+
+	// Merging, see scheduler.go
+	strategy				CompactionStrategy
+	compactWake			chan struct{}	// Holds at most one pending wake up for the workers
+	running					[]*Compaction	// Merges the workers (and CompactRange) are running
+	manualCompactions	int					// Running CompactRange calls, the workers wait for them
 	stopMerger			chan struct{}
 	mergerDone			sync.WaitGroup
+	closed					bool
+
+	mergeFinished		*sync.Cond		// Signaled on lsm.mu when a merge is done, stalled writes and CompactRange wait on it
+
+	// Write stalls
+	stalledWrites		uint64
+	stallTime				time.Duration
+
+	// Background merges that failed, they are retried after compactionRetryDelay
+	failedMerges		uint64
+	lastMergeErr		error
+	mergeFailing		bool	// No merge succeeded since lastMergeErr, stalled writes return it instead of waiting
 }
 
-func NewLSMManager(dataDir string) *LSMManager {
+func NewLSMManager(dataDir string, opts Options, snapshots *snapshotList) *LSMManager {
+	opts = opts.withDefaults()
 	lsm := &LSMManager{
 		dataDir:        dataDir,
-		mergeCh:      	make(chan []*SSTableReader, 10), // Up to 10 segments can be queued for compaction
+		opts:						opts,
+		snapshots:			snapshots,
+		blockCache:			newBlockCache(opts.BlockCacheSize),
+		values:					newValueLog(dataDir, opts),
+		strategy:				newCompactionStrategy(opts),
+		compactWake:		make(chan struct{}, 1),
 		stopMerger:			make(chan struct{}),
-		mergeThreshold:	4, // Merge when Tier 0 has 4 segments
-		maxLevels: 			MAX_LEVEL,
+		maxLevels: 			opts.MaxLevels,
 	}
+	lsm.mergeFinished = sync.NewCond(&lsm.mu)
 	
-	lsm.mergerDone.Add(1)
-	go lsm.mergerWorker()
+	for i := 0; i < opts.CompactionWorkers; i++ {
+		lsm.mergerDone.Add(1)
+		go lsm.mergerWorker()
+	}
 	
 	return lsm
 }
 
 func (lsm *LSMManager) Close() {
+	// Stalled writes and CompactRange return ErrClosed
+	lsm.mu.Lock()
+	lsm.closed = true
+	lsm.mergeFinished.Broadcast()
+	lsm.mu.Unlock()
+
 	close(lsm.stopMerger)
 	lsm.mergerDone.Wait()
 
 	lsm.mu.Lock()
 	defer lsm.mu.Unlock()
 
+	lsm.closeTiers()
+	lsm.values.close()
+	if lsm.manifestLog != nil {
+		lsm.manifestLog.Close()
+		lsm.manifestLog = nil
+	}
+}
+
+func (lsm *LSMManager) closeTiers() {
 	for _, tier := range lsm.tiers {
 		for _, sst := range tier.Segments {
 			sst.Close()
@@ -71,9 +128,20 @@ func (lsm *LSMManager) Close() {
 	}
 }
 
-// Get searches for a key in all older segments
-// It returns (value, found)
-func (lsm *LSMManager) Get(key []byte) ([]byte, bool) {
+// Get searches for a key in all older segments, only versions with a sequence number <= seq are seen
+// It returns (value, kind, found, err), a tombstone is found with KindDelete
+// A corrupted SSTable stops the search, we can't know if it had a newer version
+func (lsm *LSMManager) Get(key []byte, seq uint64) ([]byte, byte, bool, error) {
+	entry, found, err := lsm.getEntry(key, seq)
+	if found && err == nil {
+		entry, err = lsm.resolveValue(entry)
+	}
+	return entry.Value, entry.Kind, found, err
+}
+
+// Same as Get, returns the whole record so callers can see its sequence number.
+// Values in the value log are returned as a KindValuePointer record
+func (lsm *LSMManager) getEntry(key []byte, seq uint64) (kvEntry, bool, error) {
 	lsm.mu.RLock()
 	defer lsm.mu.RUnlock()
 
@@ -86,14 +154,66 @@ func (lsm *LSMManager) Get(key []byte) ([]byte, bool) {
 		for i := len(tier.Segments) - 1; i >= 0; i-- {
 			sst := tier.Segments[i]
 
-			// This already handles the bloom filter check and range check
-			val, err := sst.Get(key)
+			// Merge outputs split a tier into many small key ranges, most of them can't have the key
+			if !sst.overlaps(key, key) {
+				continue
+			}
+
+			// This already handles the bloom filter check
+			entry, err := sst.getEntry(key, seq)
 			if err == nil {
-				return val, true
+				return entry, true, nil
+			}
+			if !errors.Is(err, ErrNotFound) {
+				return kvEntry{}, false, err
 			}
 		}
 	}
-	return nil, false
+	return kvEntry{}, false, nil
+}
+
+// Highest sequence number in the SSTables
+func (lsm *LSMManager) MaxSeq() uint64 {
+	lsm.mu.RLock()
+	defer lsm.mu.RUnlock()
+
+	var maxSeq uint64
+	for _, tier := range lsm.tiers {
+		for _, sst := range tier.Segments {
+			if sst.MaxSeq() > maxSeq {
+				maxSeq = sst.MaxSeq()
+			}
+		}
+	}
+	return maxSeq
+}
+
+// Opens an iterator starting at start for every SSTable with keys in [start, end), ordered like Get:
+// Tier 0 newest -> Tier N oldest. nil end means no upper bound
+func (lsm *LSMManager) NewIterators(start, end []byte) ([]recordIterator, error) {
+	lsm.mu.RLock()
+	defer lsm.mu.RUnlock()
+
+	var iters []recordIterator
+	for _, tier := range lsm.tiers {
+		for i := len(tier.Segments) - 1; i >= 0; i-- {
+			// Tables outside the range aren't opened at all
+			sst := tier.Segments[i]
+			if bytes.Compare(sst.MaxKey(), start) < 0 || (end != nil && bytes.Compare(sst.MinKey(), end) >= 0) {
+				continue
+			}
+
+			it, err := tier.Segments[i].NewIterator(start)
+			if err != nil {
+				for _, opened := range iters {
+					opened.Close()
+				}
+				return nil, fmt.Errorf("failed to open iterator for %s: %w", tier.Segments[i].Path, err)
+			}
+			iters = append(iters, it)
+		}
+	}
+	return iters, nil
 }
 
 // Loads the db structure from the MANIFEST file or initializes a new one
@@ -101,7 +221,25 @@ func (lsm *LSMManager) InitState() (*Manifest, error) {
 	manifestPath := filepath.Join(lsm.dataDir, "MANIFEST")
 	f, err := os.Open(manifestPath)
 	if os.IsNotExist(err) {
-		return lsm.initializeFromDirectory()
+		// A log without a checkpoint has nothing to apply to
+		os.Remove(filepath.Join(lsm.dataDir, manifestLogName))
+		manifest, err := lsm.initializeFromDirectory()
+		if err != nil {
+			return nil, err
+		}
+		if err := lsm.openManifestLog(); err != nil {
+			lsm.closeTiers()
+			lsm.tiers = nil
+			return nil, err
+		}
+		// Edits need a checkpoint to apply to
+		if err := lsm.checkpoint(); err != nil {
+			lsm.closeTiers()
+			lsm.tiers = nil
+			return nil, fmt.Errorf("failed to write initial manifest: %w", err)
+		}
+		lsm.scheduleCompaction()
+		return manifest, nil
 	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to open manifest: %w", err)
@@ -111,22 +249,47 @@ func (lsm *LSMManager) InitState() (*Manifest, error) {
 	// It exists so we error out
 	var manifest Manifest
 	if err := json.NewDecoder(f).Decode(&manifest); err != nil {
-		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+		return nil, &CorruptionError{Path: manifestPath, Reason: fmt.Sprintf("failed to parse manifest: %v", err)}
+	}
+
+	// Changes since the checkpoint
+	replayed, err := replayManifestLog(lsm.dataDir, &manifest)
+	if err != nil {
+		return nil, err
 	}
 
+	lsm.lastEdit = manifest.LastEdit
+	lsm.editsSinceCheckpoint = replayed
 	lsm.nextEntryID = manifest.NextEntryID
+	lsm.activeWAL = manifest.ActiveWAL
+	lsm.flushingWAL = manifest.FlushingWAL
 	
-	validFiles := make(map[string]bool)
+	validFiles := map[string]bool{manifestLogName: true}
 
 	// Load Tiers
 	for _, mt := range manifest.Tiers {
 		var tierSegments []*SSTableReader
 		for _, segName := range mt.Segments {
-			seg, _ := LoadSSTable(filepath.Join(lsm.dataDir, segName))
+			seg, err := lsm.loadSSTable(filepath.Join(lsm.dataDir, segName))
+			if err != nil {
+				lsm.closeTiers()
+				lsm.tiers = nil
+				for _, loaded := range tierSegments {
+					loaded.Close()
+				}
+				return nil, fmt.Errorf("failed to load SSTable %s: %w", segName, err)
+			}
 			tierSegments = append(tierSegments, seg)
 			validFiles[segName] = true
 		}
 		
+		// Edits add files at the end of their tier, leveled levels are sorted by key
+		if manifest.Compaction == Leveled.String() && mt.Level > 0 {
+			sort.Slice(tierSegments, func(i, j int) bool {
+				return bytes.Compare(tierSegments[i].MinKey(), tierSegments[j].MinKey()) < 0
+			})
+		}
+
 		// Build the in memory segments for the segment manager
 		lsm.tiers = append(lsm.tiers, Tier{
 			Level: mt.Level,
@@ -137,11 +300,59 @@ func (lsm *LSMManager) InitState() (*Manifest, error) {
 	if manifest.ActiveWAL != "" {
 		validFiles[manifest.ActiveWAL] = true
 	}
+	if manifest.FlushingWAL != "" {
+		validFiles[manifest.FlushingWAL] = true
+	}
+	if err := lsm.values.open(manifest.ValueLogs); err != nil {
+		lsm.closeTiers()
+		lsm.tiers = nil
+		lsm.values.close()
+		return nil, err
+	}
+	for _, name := range manifest.ValueLogs {
+		validFiles[name] = true
+	}
+
+	// Another strategy can leave overlapping segments in a level, leveled compaction needs
+	// them back in L0 and sorts them into levels again
+	previous := manifest.Compaction
+	if previous == "" {
+		previous = SizeTiered.String()
+	}
+	if err := lsm.openManifestLog(); err != nil {
+		lsm.closeTiers()
+		lsm.tiers = nil
+		return nil, err
+	}
+	if previous != lsm.strategy.Name() && lsm.opts.CompactionStyle == Leveled {
+		lsm.tiers = flattenTiers(lsm.tiers)
+	}
+
+	// A new strategy or a long log, start from a fresh checkpoint
+	if previous != lsm.strategy.Name() || replayed >= manifestCheckpointInterval {
+		if err := lsm.checkpoint(); err != nil {
+			lsm.closeTiers()
+			lsm.tiers = nil
+			return nil, fmt.Errorf("failed to checkpoint manifest: %w", err)
+		}
+	}
 
 	lsm.cleanupDirectory(validFiles)
+
+	// Merges that were pending when we closed or crashed start again
+	lsm.scheduleCompaction()
 	return &manifest, nil
 }
 
+// Every segment in one tier, oldest first
+func flattenTiers(tiers []Tier) []Tier {
+	var segments []*SSTableReader
+	for i := len(tiers) - 1; i >= 0; i-- {
+		segments = append(segments, tiers[i].Segments...)
+	}
+	return []Tier{{Level: 0, Segments: segments}}
+}
+
 // Only used when MANIFEST doesn't exist
 func (lsm *LSMManager) initializeFromDirectory() (*Manifest, error) {
 	segments, err := lsm.DiscoverSegments()
@@ -161,12 +372,7 @@ func (lsm *LSMManager) initializeFromDirectory() (*Manifest, error) {
 	lsm.tiers = []Tier{{Level: 0, Segments: tierSegments}}
 	lsm.nextEntryID = segments[len(segments)-1].Id + 1
 
-	// Fallback to writing manifest line by line
 	manifest := lsm.buildManifestFromState()
-	if err := lsm.writeManifest(manifest); err != nil {
-    return nil, fmt.Errorf("failed to write initial manifest: %w", err)
-  }
-	
 	return &manifest, nil
 }
 
@@ -187,7 +393,13 @@ func (lsm *LSMManager) DiscoverSegments() ([]*SSTableReader, error) {
 		name := e.Name()
 		if _, ok := parseSegmentID(name); ok {
 			SSTablePath := filepath.Join(lsm.dataDir, name)
-			SSTable, _ := LoadSSTable(SSTablePath)
+			SSTable, err := lsm.loadSSTable(SSTablePath)
+			if err != nil {
+				for _, loaded := range segments {
+					loaded.Close()
+				}
+				return nil, fmt.Errorf("failed to load SSTable %s: %w", name, err)
+			}
 			segments = append(segments, SSTable)
 		}
 	}
@@ -199,6 +411,11 @@ func (lsm *LSMManager) DiscoverSegments() ([]*SSTableReader, error) {
 func (lsm *LSMManager) buildManifestFromState() Manifest {
 	manifest := Manifest{
 		NextEntryID:	 lsm.nextEntryID,
+		ActiveWAL:		 lsm.activeWAL,
+		FlushingWAL:	 lsm.flushingWAL,
+		Compaction:		 lsm.strategy.Name(),
+		LastEdit:			 lsm.lastEdit,
+		ValueLogs:		 lsm.values.names(),
 	}
 
 	for _, tier := range lsm.tiers {
@@ -242,7 +459,7 @@ func (lsm *LSMManager) cleanupDirectory(validFiles map[string]bool) {
 	entries, _ := os.ReadDir(lsm.dataDir)
 	for _, entry := range entries {
 		name := entry.Name()
-		if !validFiles[name] && (strings.HasSuffix(name, ".db") || strings.HasSuffix(name, ".idx") || strings.HasSuffix(name, ".log")) {
+		if !validFiles[name] && (strings.HasSuffix(name, ".db") || strings.HasSuffix(name, ".idx") || strings.HasSuffix(name, ".log") || strings.HasSuffix(name, valueLogExt)) {
 			os.Remove(filepath.Join(lsm.dataDir, name))
 		}
 	}
@@ -252,9 +469,40 @@ func (lsm *LSMManager) UpdateActiveWAL(walName string) error {
 	lsm.mu.Lock()
 	defer lsm.mu.Unlock()
 
-	manifest := lsm.buildManifestFromState()
-	manifest.ActiveWAL = walName
-	return lsm.writeManifest(manifest)
+	lsm.activeWAL = walName
+	return lsm.logEdit(versionEdit{ActiveWAL: &walName})
+}
+
+// Switches to a new WAL after a memtable rotation. The old one is kept as the flushing WAL
+// until AddSSTable commits its SSTable, so a crash during the flush doesn't lose it
+func (lsm *LSMManager) RotateWAL(walName string) error {
+	lsm.mu.Lock()
+	defer lsm.mu.Unlock()
+
+	previousActive, previousFlushing := lsm.activeWAL, lsm.flushingWAL
+	flushingWAL := lsm.activeWAL
+	lsm.flushingWAL = flushingWAL
+	lsm.activeWAL = walName
+	if err := lsm.logEdit(versionEdit{ActiveWAL: &walName, FlushingWAL: &flushingWAL}); err != nil {
+		lsm.activeWAL, lsm.flushingWAL = previousActive, previousFlushing
+		return err
+	}
+	return nil
+}
+
+// Creates a new WAL name, it shares the id counter with SSTables so names never repeat
+func (lsm *LSMManager) CreateWALName() string {
+	lsm.mu.Lock()
+	defer lsm.mu.Unlock()
+
+	for {
+		name := fmt.Sprintf("wal_%04d.log", lsm.nextEntryID)
+		lsm.nextEntryID++
+		// Older versions named WALs without taking an id, skip the ones in use
+		if name != lsm.activeWAL && name != lsm.flushingWAL {
+			return name
+		}
+	}
 }
 
 // Creates a new SSTable path and increments the nextEntryID
@@ -268,10 +516,10 @@ func (lsm *LSMManager) CreateSSTablePath() string {
 	return filepath.Join(lsm.dataDir, filename)
 }
 
-// Adds a new SSTable to the manifest
+// Adds a flushed SSTable to the manifest, its WAL isn't needed anymore
 func (lsm *LSMManager) AddSSTable(sstPath string) error {
 	// Load
-	sst, err := LoadSSTable(sstPath)
+	sst, err := lsm.loadSSTable(sstPath)
 	if err != nil {
 		return fmt.Errorf("failed to load SSTable: %w", err)
 	}
@@ -283,36 +531,37 @@ func (lsm *LSMManager) AddSSTable(sstPath string) error {
 		lsm.tiers = []Tier{{Level: 0, Segments: []*SSTableReader{}}}
 	}
 	lsm.tiers[0].Segments = append(lsm.tiers[0].Segments, sst)
+	lsm.flushingWAL = ""
 
-	manifest := lsm.buildManifestFromState()
-	if err := lsm.writeManifest(manifest); err != nil {
+	edit := versionEdit{FlushingWAL: new(string)}
+	edit.add(0, sst)
+	if err := lsm.logEdit(edit); err != nil {
 		lsm.mu.Unlock()
 		return fmt.Errorf("failed to write manifest: %w", err)
 	}
 
 	// Check if we need merges
-	var shouldMerge bool
-	var toMerge []*SSTableReader
-	if len(lsm.tiers[0].Segments) >= lsm.mergeThreshold {
-		shouldMerge = true
-		toMerge = make([]*SSTableReader, len(lsm.tiers[0].Segments))
-		copy(toMerge, lsm.tiers[0].Segments)
-	}
+	pending := len(lsm.strategy.Pending(lsm.tiers)) > 0
 
 	lsm.mu.Unlock()
 
-	// Send it to the merge channel, skip if the channel is full
-	if shouldMerge {
-		select{
-			case lsm.mergeCh <- toMerge:
-			default:
-				fmt.Printf("merge channel is full, skipping merge\n")
-		}
+	if pending {
+		lsm.scheduleCompaction()
 	}
 
 	return nil
 }
 
+// Loads an SSTable that reads its blocks through the store's block cache
+func (lsm *LSMManager) loadSSTable(path string) (*SSTableReader, error) {
+	sst, err := LoadSSTable(path)
+	if err != nil {
+		return nil, err
+	}
+	sst.cache = lsm.blockCache
+	return sst, nil
+}
+
 func parseSegmentID(filename string) (int, bool) {
 	var id int
 	if _, err := fmt.Sscanf(filename, "sst_%04d.db", &id); err == nil {
@@ -0,0 +1,221 @@
+package v6
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// The MANIFEST file is a checkpoint of the whole state, every change after it is appended
+// to MANIFEST.log as a version edit and fsynced. Opening replays the edits on top of the
+// checkpoint. Edits are framed like WAL entries, [payloadLen uint32][crc32c uint32][json payload]
+//
+// A merge commits with one edit that adds its outputs and removes its inputs. If we crash
+// before the edit the outputs are orphans, after it the inputs are, InitState removes both
+const (
+	manifestLogName	= "MANIFEST.log"
+
+	// Edits appended before the MANIFEST is rewritten and the log starts over
+	manifestCheckpointInterval = 100
+)
+
+type versionEdit struct {
+	Seq					int					`json:"seq"`	// Edits up to the checkpoint's last_edit are already in it
+	Added				[]fileEdit	`json:"added,omitempty"`
+	Removed			[]fileEdit	`json:"removed,omitempty"`
+	ActiveWAL		*string			`json:"active_wal,omitempty"`
+	FlushingWAL	*string			`json:"flushing_wal,omitempty"`
+	NextEntryID	int					`json:"next_entry_id"`
+
+	AddedValueLogs		[]string	`json:"added_value_logs,omitempty"`
+	RemovedValueLogs	[]string	`json:"removed_value_logs,omitempty"`
+}
+
+type fileEdit struct {
+	Level	int			`json:"level"`
+	Name	string	`json:"name"`
+}
+
+func (e *versionEdit) add(level int, segments ...*SSTableReader) {
+	for _, seg := range segments {
+		e.Added = append(e.Added, fileEdit{Level: level, Name: filepath.Base(seg.Path)})
+	}
+}
+
+func (e *versionEdit) remove(level int, segments ...*SSTableReader) {
+	for _, seg := range segments {
+		e.Removed = append(e.Removed, fileEdit{Level: level, Name: filepath.Base(seg.Path)})
+	}
+}
+
+// Applies the edit to a manifest, files are added at the end of their tier
+func (m *Manifest) apply(edit versionEdit) {
+	for _, removed := range edit.Removed {
+		if removed.Level >= len(m.Tiers) {
+			continue
+		}
+		segments := m.Tiers[removed.Level].Segments
+		for i, name := range segments {
+			if name == removed.Name {
+				m.Tiers[removed.Level].Segments = append(segments[:i:i], segments[i+1:]...)
+				break
+			}
+		}
+	}
+	for _, added := range edit.Added {
+		for len(m.Tiers) <= added.Level {
+			m.Tiers = append(m.Tiers, ManifestTier{Level: len(m.Tiers)})
+		}
+		m.Tiers[added.Level].Segments = append(m.Tiers[added.Level].Segments, added.Name)
+	}
+	for _, removed := range edit.RemovedValueLogs {
+		for i, name := range m.ValueLogs {
+			if name == removed {
+				m.ValueLogs = append(m.ValueLogs[:i:i], m.ValueLogs[i+1:]...)
+				break
+			}
+		}
+	}
+	m.ValueLogs = append(m.ValueLogs, edit.AddedValueLogs...)
+	if edit.ActiveWAL != nil {
+		m.ActiveWAL = *edit.ActiveWAL
+	}
+	if edit.FlushingWAL != nil {
+		m.FlushingWAL = *edit.FlushingWAL
+	}
+	if edit.NextEntryID > m.NextEntryID {
+		m.NextEntryID = edit.NextEntryID
+	}
+	m.LastEdit = edit.Seq
+}
+
+// Appends the edit to the log and syncs it, expects lsm.mu held
+// Every manifestCheckpointInterval edits the full MANIFEST is rewritten instead
+// lastEdit only moves once the edit is on disk
+func (lsm *LSMManager) logEdit(edit versionEdit) error {
+	edit.Seq = lsm.lastEdit + 1
+	edit.NextEntryID = lsm.nextEntryID
+
+	if lsm.manifestLog == nil || lsm.editsSinceCheckpoint+1 >= manifestCheckpointInterval {
+		// The checkpoint is built from the state, its last_edit has to be this edit
+		lsm.lastEdit = edit.Seq
+		if err := lsm.checkpoint(); err != nil {
+			lsm.lastEdit--
+			return err
+		}
+		return nil
+	}
+
+	payload, err := json.Marshal(edit)
+	if err != nil {
+		return err
+	}
+	if err := lsm.appendManifestLog(frameWALEntry(payload)); err != nil {
+		return err
+	}
+	lsm.lastEdit = edit.Seq
+	lsm.editsSinceCheckpoint++
+	return nil
+}
+
+// Writes and syncs a frame. A failed append is cut off so later edits never follow a
+// partial frame, if even that fails the log is dropped and every edit checkpoints instead
+func (lsm *LSMManager) appendManifestLog(frame []byte) error {
+	stat, err := lsm.manifestLog.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to append manifest edit: %w", err)
+	}
+
+	if _, err = lsm.manifestLog.Write(frame); err != nil {
+		err = fmt.Errorf("failed to append manifest edit: %w", err)
+	} else if err = lsm.manifestLog.Sync(); err != nil {
+		err = fmt.Errorf("failed to sync manifest log: %w", err)
+	}
+	if err != nil {
+		if truncErr := lsm.manifestLog.Truncate(stat.Size()); truncErr != nil {
+			lsm.manifestLog.Close()
+			lsm.manifestLog = nil
+		}
+		return err
+	}
+	return nil
+}
+
+// Rewrites the MANIFEST with the current state and empties the log, expects lsm.mu held
+// If we crash between the two the edits in the log are older than last_edit and skipped
+func (lsm *LSMManager) checkpoint() error {
+	manifest := lsm.buildManifestFromState()
+	if err := lsm.writeManifest(manifest); err != nil {
+		return err
+	}
+
+	if lsm.manifestLog != nil {
+		if err := lsm.manifestLog.Truncate(0); err != nil {
+			return fmt.Errorf("failed to truncate manifest log: %w", err)
+		}
+		if err := lsm.manifestLog.Sync(); err != nil {
+			return err
+		}
+	}
+	lsm.editsSinceCheckpoint = 0
+	return nil
+}
+
+func (lsm *LSMManager) openManifestLog() error {
+	file, err := os.OpenFile(filepath.Join(lsm.dataDir, manifestLogName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open manifest log: %w", err)
+	}
+	lsm.manifestLog = file
+	return nil
+}
+
+// Applies the edits of the log newer than the checkpoint, returns how many were applied
+// A torn last edit (we crashed while appending it) is cut off, like the WAL does. A bad edit
+// with valid ones after it is corruption, cutting it off would lose the later edits
+func replayManifestLog(dataDir string, manifest *Manifest) (int, error) {
+	path := filepath.Join(dataDir, manifestLogName)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to read manifest log: %w", err)
+	}
+
+	applied := 0
+	offset := 0
+	for offset < len(data) {
+		if len(data)-offset < walFrameHeaderSize {
+			return applied, os.Truncate(path, int64(offset))
+		}
+		header := data[offset : offset+walFrameHeaderSize]
+		end := offset + walFrameHeaderSize + int(binary.BigEndian.Uint32(header[0:4]))
+		if end > len(data) {
+			if containsValidFrame(data[offset+walFrameHeaderSize:]) {
+				return applied, &CorruptionError{Path: path, Offset: int64(offset), Reason: "edit length runs past the end of the file"}
+			}
+			return applied, os.Truncate(path, int64(offset))
+		}
+		payload := data[offset+walFrameHeaderSize : end]
+		if walChecksum(header[0:4], payload) != binary.BigEndian.Uint32(header[4:8]) {
+			if end == len(data) {
+				return applied, os.Truncate(path, int64(offset))
+			}
+			return applied, &CorruptionError{Path: path, Offset: int64(offset), Reason: "edit checksum mismatch"}
+		}
+
+		var edit versionEdit
+		if err := json.Unmarshal(payload, &edit); err != nil {
+			return applied, &CorruptionError{Path: path, Offset: int64(offset), Reason: fmt.Sprintf("invalid edit: %v", err)}
+		}
+		if edit.Seq > manifest.LastEdit {
+			manifest.apply(edit)
+			applied++
+		}
+		offset = end
+	}
+	return applied, nil
+}
@@ -0,0 +1,71 @@
+package v6
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Writes count edits that each add one SSTable to L0, returns the log's contents
+func writeTestManifestLog(t *testing.T, dir string, count int) []byte {
+	t.Helper()
+
+	var data []byte
+	for i := 1; i <= count; i++ {
+		edit := versionEdit{Seq: i, Added: []fileEdit{{Level: 0, Name: fmt.Sprintf("sst_%04d.sst", i)}}}
+		payload, err := json.Marshal(edit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, frameWALEntry(payload)...)
+	}
+	if err := os.WriteFile(filepath.Join(dir, manifestLogName), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestReplayManifestLogTruncatesTornTail(t *testing.T) {
+	dir := t.TempDir()
+	data := writeTestManifestLog(t, dir, 5)
+	path := filepath.Join(dir, manifestLogName)
+	if err := os.WriteFile(path, data[:len(data)-3], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var manifest Manifest
+	applied, err := replayManifestLog(dir, &manifest)
+	if err != nil {
+		t.Fatalf("expected the torn edit to be dropped, got %v", err)
+	}
+	if applied != 4 || manifest.LastEdit != 4 {
+		t.Errorf("expected 4 edits applied, got %d (last edit %d)", applied, manifest.LastEdit)
+	}
+	if got := fileSize(t, path); got >= int64(len(data)-3) {
+		t.Errorf("expected the torn edit to be truncated, the log is still %d bytes", got)
+	}
+}
+
+func TestReplayManifestLogCorruptLengthInTheMiddle(t *testing.T) {
+	dir := t.TempDir()
+	data := writeTestManifestLog(t, dir, 5)
+	path := filepath.Join(dir, manifestLogName)
+
+	binary.BigEndian.PutUint32(data[0:4], 1<<20)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var manifest Manifest
+	_, err := replayManifestLog(dir, &manifest)
+	if !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("expected ErrCorrupt, got %v", err)
+	}
+	if got := fileSize(t, path); got != int64(len(data)) {
+		t.Errorf("the log must not be truncated, size went from %d to %d", len(data), got)
+	}
+}
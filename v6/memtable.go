@@ -1,7 +1,9 @@
 package v6
 
 import (
+	"bytes"
 	"fmt"
+	"math"
 	"sync"
 )
 
@@ -12,23 +14,35 @@ type MemTable struct {
 	count			int
 	readOnly	bool
 	wal				*WAL
+	recovery	WALReplayStats	// What the WAL replay found when the memtable was opened
+	lastSeq		uint64					// Highest sequence number in the memtable
 }
 
-func NewMemTable(walPath string) (*MemTable, error) {
+// lastSeq is the highest sequence number already used, WAL entries from older versions
+// have none and get the ones after it
+func NewMemTable(walPath string, durability Durability, lastSeq uint64) (*MemTable, error) {
 	mt := &MemTable{
 		skiplist: NewSkipList(),
 		size: 		0,
 		count:		0,
 		readOnly: false,
+		lastSeq:	lastSeq,
 	}
 
 	// Replay if it exists
-	if err := ReplayWAL(walPath, mt); err != nil {
+	stats, err := ReplayWAL(walPath, mt)
+	if err != nil {
+		return nil, err
+	}
+	mt.recovery = stats
+
+	// WALs from older versions have no checksums, rewrite them before appending
+	if err := upgradeWAL(walPath, mt); err != nil {
 		return nil, err
 	}
 
 	// Open the WAL
-	wal, err := NewWAL(walPath)
+	wal, err := NewWAL(walPath, durability)
 	if err != nil {
 		return nil, err
 	}
@@ -37,17 +51,6 @@ func NewMemTable(walPath string) (*MemTable, error) {
 	return mt, nil
 }
 
-// Used for compaction/recovery
-func NewMemTableWithoutWAL() *MemTable {
-	return &MemTable{
-		skiplist: NewSkipList(),
-		size:     0,
-		count:    0,
-		readOnly: false,
-		wal:      nil,
-	}
-}
-
 func (mt *MemTable) NewIterator() *Iterator {
 	mt.mu.RLock()
 	defer mt.mu.RUnlock()
@@ -55,6 +58,18 @@ func (mt *MemTable) NewIterator() *Iterator {
 	return mt.skiplist.NewIterator()
 }
 
+// Returns how many WAL entries were recovered and how much of a torn tail was dropped
+func (mt *MemTable) RecoveryStats() WALReplayStats {
+	return mt.recovery
+}
+
+func (mt *MemTable) LastSeq() uint64 {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+
+	return mt.lastSeq
+}
+
 func (mt *MemTable) Size() int64 {
 	mt.mu.RLock()
 	defer mt.mu.RUnlock()
@@ -76,6 +91,14 @@ func (mt *MemTable) MakeReadOnly() {
 	mt.readOnly = true
 }
 
+// Undoes MakeReadOnly when a rotation couldn't be committed
+func (mt *MemTable) makeWritable() {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	mt.readOnly = false
+}
+
 func (mt *MemTable) IsReadOnly() bool {
 	mt.mu.RLock()
 	defer mt.mu.RUnlock()
@@ -90,79 +113,112 @@ func (mt *MemTable) Find(key []byte) ([]byte, error) {
 	return mt.skiplist.Find(key)
 }
 
-// Inserts or updates the KV and updates the size
-func (mt *MemTable) Insert(key, value []byte) error {
+// Returns the value and kind for the key, so callers can tell tombstones apart
+func (mt *MemTable) Lookup(key []byte) ([]byte, byte, bool) {
+	entry, found := mt.LookupAt(key, math.MaxUint64)
+	return entry.Value, entry.Kind, found
+}
+
+// Newest version of the key with a sequence number <= seq, tombstones and expired puts included
+func (mt *MemTable) LookupAt(key []byte, seq uint64) (kvEntry, bool) {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+
+	nd := mt.skiplist.LookupAt(key, seq)
+	if nd == nil {
+		return kvEntry{}, false
+	}
+	return kvEntry{Key: nd.Key, Value: nd.Value, Kind: nd.Kind, Seq: nd.Seq, ExpiresAt: nd.ExpiresAt}, true
+}
+
+// Newest version of the key, tombstones included
+func (mt *MemTable) latestEntry(key []byte) (kvEntry, bool) {
+	return mt.LookupAt(key, math.MaxUint64)
+}
+
+// Adds a new version of the KV and updates the size
+// With group commit the write may not be synced yet, call Wait on the commit after releasing locks
+func (mt *MemTable) Insert(key, value []byte, seq uint64) (walCommit, error) {
+	return mt.write(kvEntry{Key: key, Value: value, Kind: KindPut, Seq: seq})
+}
+
+// Same as Insert, the key reads as missing once expiresAt (unix nanoseconds) has passed
+func (mt *MemTable) InsertExpiring(key, value []byte, seq uint64, expiresAt int64) (walCommit, error) {
+	return mt.write(kvEntry{Key: key, Value: value, Kind: KindPut, Seq: seq, ExpiresAt: expiresAt})
+}
+
+// Logs the op in the WAL and applies it
+func (mt *MemTable) write(op kvEntry) (walCommit, error) {
 	mt.mu.Lock()
 	defer mt.mu.Unlock()
 
 	if mt.readOnly {
-		panic("readonly memtable")
+		return walCommit{}, ErrReadOnly
 	}
 
-
 	// Write to WAL first (for durability)
+	var commit walCommit
 	if mt.wal != nil {
-		if err := mt.wal.WritePut(key, value); err != nil {
-			return err
+		var err error
+		if commit, err = mt.wal.appendEntry(op); err != nil {
+			return walCommit{}, err
 		}
 	}
 
-	// Check if the key exists, to update or add the new KV size to the memtable size
-	existing, err := mt.skiplist.Find(key)
-	if err == nil {
-		mt.size -= int64(len(existing))
-		mt.size += int64(len(value))
-	} else {
-		mt.size += int64(len(key) + len(value))
-		mt.count++
-	}
+	mt.applyOp(op)
+	return commit, nil
+}
 
-	mt.skiplist.Insert(key, value)
-	return nil
+// Applies an entry of a WAL without sequence numbers while the memtable is being rebuilt
+func (mt *MemTable) replayLegacy(key, value []byte, kind byte) {
+	mt.applyOp(kvEntry{Key: key, Value: value, Kind: kind, Seq: mt.lastSeq + 1})
 }
 
-// Used for compaction
-func (mt *MemTable) InsertWithoutWAL(key, value []byte) {
-	mt.mu.Lock()
-	defer mt.mu.Unlock()
+// Applies a put or delete from a batch or the WAL replay, expects mt.mu to be held
+// (or the memtable to not be shared yet)
+func (mt *MemTable) applyOp(op kvEntry) {
+	mt.size += int64(len(op.Key) + len(op.Value))
+	mt.count++
+	if op.Seq > mt.lastSeq {
+		mt.lastSeq = op.Seq
+	}
 
-	// Check if the key exists, to update or add the new KV size to the memtable size
-	existing, err := mt.skiplist.Find(key)
-	if err == nil {
-		mt.size -= int64(len(existing))
-		mt.size += int64(len(value))
+	if op.Kind == KindDelete {
+		mt.skiplist.InsertTombstone(op.Key, op.Seq)
 	} else {
-		mt.size += int64(len(key) + len(value))
-		mt.count++
+		mt.skiplist.InsertExpiring(op.Key, op.Value, op.Seq, op.ExpiresAt)
 	}
-
-	mt.skiplist.Insert(key, value)
 }
 
-// Inserts or updates the KV and updates the size
-func (mt *MemTable) Delete(key []byte) bool {
+// Writes the batch as one WAL entry and applies it while holding the lock,
+// readers see all of it or none of it. Ops get the sequence numbers from baseSeq on
+func (mt *MemTable) ApplyBatch(batch *WriteBatch, baseSeq uint64) (walCommit, error) {
 	mt.mu.Lock()
 	defer mt.mu.Unlock()
 
 	if mt.readOnly {
-		panic("readonly memtable")
+		return walCommit{}, ErrReadOnly
 	}
-	
-	// Write to WAL first (for durability)
+
+	var commit walCommit
 	if mt.wal != nil {
-		if err := mt.wal.WriteDelete(key); err != nil {
-			return false
+		var err error
+		if commit, err = mt.wal.appendBatch(batch, baseSeq); err != nil {
+			return walCommit{}, err
 		}
 	}
 
-	// Check if the key exists, to update or add the new KV size to the memtable size
-	value, err := mt.skiplist.Find(key)
-	if err == nil {
-		mt.size -= int64(len(key) + len(value))
-		mt.count--
+	for i, op := range batch.ops {
+		op.Seq = baseSeq + uint64(i)
+		mt.applyOp(op)
 	}
+	return commit, nil
+}
 
-	return mt.skiplist.Delete(key)
+// Writes a tombstone for the key. We can't just remove it from the skiplist,
+// older versions in the SSTables would show up again
+func (mt *MemTable) Delete(key []byte, seq uint64) (walCommit, error) {
+	return mt.write(kvEntry{Key: key, Kind: KindDelete, Seq: seq})
 }
 
 func (mt *MemTable) ShouldFlush(threshold int64) bool {
@@ -172,7 +228,9 @@ func (mt *MemTable) ShouldFlush(threshold int64) bool {
 	return mt.size >= threshold
 }
 
-func (mt *MemTable) Flush(outputPath string) error {
+// Writes the versions the retention keeps, older versions nobody can see are dropped here.
+// Every kept version goes through separate, which can move its value to the value log
+func (mt *MemTable) Flush(outputPath string, opts Options, keep retention, separate func(kvEntry) (kvEntry, error)) error {
 	mt.mu.Lock()
 	if !mt.readOnly {
 		mt.readOnly = true
@@ -180,21 +238,33 @@ func (mt *MemTable) Flush(outputPath string) error {
 	count := mt.count
 	mt.mu.Unlock()
 
-	writer, err := NewSSTableWriter(outputPath, count)
+	writer, err := NewSSTableWriter(outputPath, count, opts, 0)
 	if err != nil {
 		return fmt.Errorf("failed to create SSTable writer: %w", err)
 	}
 
+	write := func(entries []kvEntry) error {
+		for i := range entries {
+			if entries[i], err = separate(entries[i]); err != nil {
+				return fmt.Errorf("failed to write value: %w", err)
+			}
+		}
+		if err := writer.AppendAll(entries); err != nil {
+			return fmt.Errorf("failed to write entry: %w", err)
+		}
+		return nil
+	}
+
+	filter := keep.filter()
 	iter := mt.skiplist.NewIterator()
-	entryCount := 0
 	for iter.Next() {
-		key := iter.Key()
-		value := iter.Value()
-
-		if err := writer.Append(key, value); err != nil {
-			return fmt.Errorf("failed to write entry: %w", err)
+		entry := kvEntry{Key: iter.Key(), Value: iter.Value(), Kind: iter.Kind(), Seq: iter.Seq(), ExpiresAt: iter.ExpiresAt()}
+		if err := write(filter.add(entry)); err != nil {
+			return err
 		}
-		entryCount++
+	}
+	if err := write(filter.finish()); err != nil {
+		return err
 	}
 
 	if err := writer.Finalize(); err != nil {
@@ -216,18 +286,50 @@ func (mt *MemTable) ForEach(fn func(key, value []byte) bool) {
 	}
 }
 
+// Copies the entries in [start, end) visible at seq for scans, nil end means no upper bound
+// Only the newest visible version of each key is copied
+func (mt *MemTable) CollectRange(start, end []byte, seq uint64) []kvEntry {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+
+	var entries []kvEntry
+	iter := mt.skiplist.NewIterator()
+	if !iter.Seek(start) {
+		return entries
+	}
+	var lastKey []byte
+	for ; iter.Valid(); iter.Next() {
+		if end != nil && bytes.Compare(iter.Key(), end) >= 0 {
+			break
+		}
+		if iter.Seq() > seq || (lastKey != nil && bytes.Equal(iter.Key(), lastKey)) {
+			continue
+		}
+		lastKey = iter.Key()
+		entries = append(entries, kvEntry{
+			Key:   append([]byte(nil), iter.Key()...),
+			Value: append([]byte(nil), iter.Value()...),
+			Kind:  iter.Kind(),
+			Seq:   iter.Seq(),
+			ExpiresAt: iter.ExpiresAt(),
+		})
+	}
+	return entries
+}
+
 // Resets the memtable
-func (mt *MemTable) Clear() {
+func (mt *MemTable) Clear() error {
 	mt.mu.Lock()
 	defer mt.mu.Unlock()
 
 	if mt.readOnly {
-		panic("readonly memtable")
+		return ErrReadOnly
 	}
 	
 	mt.skiplist = NewSkipList()
 	mt.size = 0
 	mt.count = 0
+	return nil
 }
 
 func (mt *MemTable) Close() error {
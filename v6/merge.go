@@ -3,60 +3,31 @@ package v6
 import (
 	"fmt"
 	"os"
-	"path/filepath"
+	"time"
 )
 
-func (lsm *LSMManager) mergerWorker() {
-	defer lsm.mergerDone.Done()
-
-	for {
-		select {
-		case <-lsm.stopMerger:
-			return
-		case sstables := <-lsm.mergeCh:
-			// Collect all segments to delete after the merge
-			toDelete := make([]*SSTableReader, 0)
-			lsm.runMergeCycle(0, sstables, &toDelete)
-			
-			// Delete old segments
-			for _, seg := range toDelete {
-				seg.Close()
-				os.Remove(seg.Path)
-			}
-		}
-	}
-}
-
-
-// Handles merge for a tier and checks if we need to cascade into merging the next tier
-func (lsm *LSMManager) runMergeCycle(level int, segmentsToMerge []*SSTableReader, toDelete *[]*SSTableReader) error {
-	newMergedSegment, err := lsm.performMerge(level, segmentsToMerge)
+// Runs one merge and commits it to the manifest
+func (lsm *LSMManager) runMergeCycle(c *Compaction, toDelete *[]*SSTableReader) error {
+	newMergedSegments, err := lsm.performMerge(c.segments(), c.Target, c.DropTombstones)
 	if err != nil {
-		return fmt.Errorf("failed merge IO for tier %d: %w", level, err)
+		return fmt.Errorf("failed merge IO for tier %d: %w", c.Level, err)
 	}
 	
 	// Locking to handle manifest (our single source of truth)
 	lsm.mu.Lock()
-	
-	// Merge files at bottom level to avoid it becoming a graveyard
-	targetLevel := level + 1
-	if level >= lsm.maxLevels {
-		targetLevel = lsm.maxLevels
-	}
 
 	// Make sure next tier exists
-	for len(lsm.tiers) <= targetLevel {
+	for len(lsm.tiers) <= c.Target {
 		lsm.tiers = append(lsm.tiers, Tier{Level: len(lsm.tiers), Segments: []*SSTableReader{}})
 	}
 	
-	// Remove old segments
-	if level < len(lsm.tiers) {
-		mergedIDs := make(map[int]bool)
-		for _, seg := range segmentsToMerge {
-			mergedIDs[seg.Id] = true
-		}
-		
-		// Keep segments that weren't merged
+	// Remove old segments, keep the ones that weren't merged
+	merged := c.segments()
+	mergedIDs := make(map[int]bool)
+	for _, seg := range merged {
+		mergedIDs[seg.Id] = true
+	}
+	for _, level := range []int{c.Level, c.Target} {
 		var remaining []*SSTableReader
 		for _, seg := range lsm.tiers[level].Segments {
 			if !mergedIDs[seg.Id] {
@@ -66,84 +37,164 @@ func (lsm *LSMManager) runMergeCycle(level int, segmentsToMerge []*SSTableReader
 		lsm.tiers[level].Segments = remaining
 	}
 	
-	// APPEND merged segment, the newest in the next tier
-	lsm.tiers[targetLevel].Segments = append(lsm.tiers[targetLevel].Segments, newMergedSegment)
-
-	// Check if this merge will fill next tier, we cascade into another merge if it does
-	var nextSegmentsToMerge []*SSTableReader
-	if len(lsm.tiers[targetLevel].Segments) >= lsm.mergeThreshold {
-		nextSegmentsToMerge = make([]*SSTableReader, len(lsm.tiers[targetLevel].Segments))
-		copy(nextSegmentsToMerge, lsm.tiers[targetLevel].Segments)
+	// Everything can be dropped at the last tier, nothing to add then
+	for _, seg := range newMergedSegments {
+		lsm.tiers[c.Target].Segments = lsm.strategy.Install(lsm.tiers[c.Target].Segments, seg, c.Target)
 	}
 
-	// Atomic commit of the new state to the manifest
-	manifest := lsm.buildManifestFromState()
-	if err := lsm.writeManifest(manifest); err != nil {
+	// Atomic commit of the new state to the manifest, one edit for the whole merge
+	var edit versionEdit
+	edit.remove(c.Level, c.Inputs...)
+	edit.remove(c.Target, c.Overlaps...)
+	edit.add(c.Target, newMergedSegments...)
+	if err := lsm.logEdit(edit); err != nil {
 		lsm.mu.Unlock()
-		return fmt.Errorf("failed to commit merge for tier %d: %w", level, err)
+		return fmt.Errorf("failed to commit merge for tier %d: %w", c.Level, err)
 	}
 
 	lsm.mu.Unlock() // Manifest is OK
 
 	// Add segments to delete after the merge and cascading merges
-	*toDelete = append(*toDelete, segmentsToMerge...)
-
-	// If we cascaded, run another merge with the newer segments
-	if nextSegmentsToMerge != nil && targetLevel < lsm.maxLevels {
-		return lsm.runMergeCycle(targetLevel, nextSegmentsToMerge, toDelete)
-	}
+	*toDelete = append(*toDelete, merged...)
 
 	return nil
 }
 
-// Goes over each segment and writes a new merged and compacted segment
-func (lsm *LSMManager) performMerge(level int, segments []*SSTableReader) (*SSTableReader, error) {
+// Goes over each segment and writes new merged and compacted segments, sorted by key
+// Segments go oldest first, the output goes to level. Returns no segments if every record was dropped
+func (lsm *LSMManager) performMerge(segments []*SSTableReader, level int, dropTombstones bool) ([]*SSTableReader, error) {
 	if len(segments) == 0 {
 		return nil, fmt.Errorf("cannot merge zero segments")
 	}
 
-	isMaxLevel := level >= lsm.maxLevels
-
-	// Temp memtable for merging
-	tempMemTable := NewMemTableWithoutWAL()
+	// Keep tombstones unless nothing older is left below the merged segments for
+	// them to hide. Expired values are reclaimed here too
+	keep := retention{
+		snapshots:			lsm.snapshots.sorted(),
+		dropTombstones:	dropTombstones,
+		now:						time.Now().UnixNano(),
+	}
 
-	// Read all segments and insert
-	for _, seg := range segments {
-		entries, err := seg.ReadAllRecords()
+	// The segments are already sorted, a heap over one iterator per segment gives every
+	// version in order while only holding one block of each segment in memory.
+	// Sources go newest first so the heap knows which copy of an unsequenced version wins
+	sources := make([]recordIterator, 0, len(segments))
+	expectedKeys := 0
+	for i := len(segments) - 1; i >= 0; i-- {
+		seg := segments[i]
+		it, err := seg.newIterator(nil, false)
 		if err != nil {
+			for _, opened := range sources {
+				opened.Close()
+			}
 			return nil, fmt.Errorf("could not read entries from segment %d: %w", seg.Id, err)
 		}
-		
-		for key, value := range entries {
-			isTombstone := string(value) == TOMBSTONE_VALUE
-		
-			// Keep tombstones unless we are merging max level segments
-			// At max level, we can remove tombstones
-			if isMaxLevel && isTombstone {
-				continue // Skip tombstones at max level
-			}
-			
-			// Insert into memtable, will overwrite if key exists
-			tempMemTable.InsertWithoutWAL([]byte(key), value)
+		sources = append(sources, it)
+		expectedKeys += seg.recordCount()
+	}
+	merged := newVersionIterator(sources)
+	defer merged.Close()
+
+	out := &mergeOutput{lsm: lsm, level: level, expectedKeys: expectedKeys}
+	var inputSize int64
+	for _, seg := range segments {
+		inputSize += seg.Size()
+	}
+	// Bloom filters sized for one output file, not the whole merge
+	if inputSize > lsm.opts.TargetFileSize {
+		out.expectedKeys = int(int64(expectedKeys)*lsm.opts.TargetFileSize/inputSize) + 1
+	}
+
+	// Stream the versions into the new SSTables, versions no snapshot can see are dropped
+	filter := keep.filter()
+	for merged.Next() {
+		if err := out.write(filter.add(merged.Entry())); err != nil {
+			out.abort()
+			return nil, err
 		}
 	}
+	if err := merged.Err(); err != nil {
+		out.abort()
+		return nil, fmt.Errorf("could not read entries from segments: %w", err)
+	}
+	if err := out.write(filter.finish()); err != nil {
+		out.abort()
+		return nil, err
+	}
+	if err := out.finish(); err != nil {
+		out.abort()
+		return nil, err
+	}
+	return out.tables, nil
+}
 
-	sstPath := lsm.CreateSSTablePath()
+// SSTables written by a merge. A new file is started once the current one reaches
+// TargetFileSize, so the bottom tier isn't one huge file with a huge bloom filter and index
+type mergeOutput struct {
+	lsm						*LSMManager
+	level					int			// Where the outputs go, picks their block codec
+	expectedKeys	int
+	writer				*SSTableWriter
+	path					string
+	tables				[]*SSTableReader
+}
 
-	// Flush memtable to sst
-	if err := tempMemTable.Flush(sstPath); err != nil {
-		return nil, fmt.Errorf("could not flush merged data to SSTable: %w", err)
+// Writes the kept versions of one key, files only roll over between keys so the
+// key ranges of the outputs never overlap
+func (out *mergeOutput) write(entries []kvEntry) error {
+	if len(entries) == 0 {
+		return nil
 	}
 
-	newSSTable, err := LoadSSTable(sstPath)
-	if err != nil {
-		return nil, fmt.Errorf("could not load merged SSTable: %w", err)
+	if out.writer == nil {
+		out.path = out.lsm.CreateSSTablePath()
+		writer, err := NewSSTableWriter(out.path, out.expectedKeys, out.lsm.opts, out.level)
+		if err != nil {
+			return fmt.Errorf("failed to create SSTable writer: %w", err)
+		}
+		out.writer = writer
+	}
+
+	if err := out.writer.AppendAll(entries); err != nil {
+		return fmt.Errorf("could not write merged SSTable: %w", err)
+	}
+	if out.writer.DataSize() >= out.lsm.opts.TargetFileSize {
+		return out.finish()
+	}
+	return nil
+}
+
+// Finalizes the current file, if any
+func (out *mergeOutput) finish() error {
+	if out.writer == nil {
+		return nil
 	}
 
-	filename := filepath.Base(sstPath)
-	var id int
-	fmt.Sscanf(filename, "sst_%04d.db", &id)
-	newSSTable.Id = id
+	writer := out.writer
+	out.writer = nil
+	if err := writer.Finalize(); err != nil {
+		writer.Abort()
+		return fmt.Errorf("failed to finalize merged SSTable: %w", err)
+	}
+
+	table, err := out.lsm.loadSSTable(out.path)
+	if err != nil {
+		os.Remove(out.path)
+		return fmt.Errorf("could not load merged SSTable: %w", err)
+	}
+	out.tables = append(out.tables, table)
+	return nil
+}
 
-	return newSSTable, nil
-}
\ No newline at end of file
+// Removes everything the merge wrote, the inputs stay in the manifest
+func (out *mergeOutput) abort() {
+	if out.writer != nil {
+		out.writer.Abort()
+		out.writer = nil
+	}
+	for _, table := range out.tables {
+		table.Close()
+		os.Remove(table.Path)
+	}
+	out.tables = nil
+}
@@ -0,0 +1,194 @@
+package v6
+
+import "time"
+
+// When WAL writes are synced to disk
+// Without a sync an acknowledged write only reached the OS and can be lost on power loss
+type Durability struct {
+	mode			durabilityMode
+	interval	time.Duration
+}
+
+type durabilityMode int
+
+// Group commit is the zero value so an empty Options gets the default
+const (
+	durabilityGroupCommit durabilityMode = iota
+	durabilityNone
+	durabilityEveryWrite
+	durabilityInterval
+)
+
+var (
+	// Writes are only flushed to the OS, a crash of the process is fine but power loss isn't
+	NoSync = Durability{mode: durabilityNone}
+
+	// Every write calls fsync before returning. Safest and slowest
+	SyncEveryWrite = Durability{mode: durabilityEveryWrite}
+
+	// Every write is synced before returning, but concurrent writers share one fsync
+	GroupCommit = Durability{mode: durabilityGroupCommit}
+)
+
+// The WAL is synced in the background every d, writes of the last d can be lost on power loss
+func SyncInterval(d time.Duration) Durability {
+	if d <= 0 {
+		return SyncEveryWrite
+	}
+	return Durability{mode: durabilityInterval, interval: d}
+}
+
+func (d Durability) String() string {
+	switch d.mode {
+	case durabilityEveryWrite:
+		return "sync-every-write"
+	case durabilityInterval:
+		return "sync-interval(" + d.interval.String() + ")"
+	case durabilityNone:
+		return "no-sync"
+	default:
+		return "group-commit"
+	}
+}
+
+// How SSTables are merged down the tiers, see compaction.go
+type CompactionStyle int
+
+const (
+	// A full tier is merged into one segment of the next tier. Cheap to write, reads
+	// have to check every segment of a tier
+	SizeTiered CompactionStyle = iota
+
+	// Every level but L0 has non overlapping segments and a size target, an SSTable over
+	// the target is merged with the overlapping SSTables of the next level only
+	Leveled
+)
+
+func (c CompactionStyle) String() string {
+	if c == Leveled {
+		return "leveled"
+	}
+	return "size-tiered"
+}
+
+// Tunables for Open, zero fields get the default value
+type Options struct {
+	Durability					Durability
+	MemTableSize				int64	// Bytes of keys and values before the memtable is flushed
+	MaxLevels						int		// Index of the last tier, tombstones are dropped when merging into it
+	MergeThreshold			int		// Segments in a tier (L0 with Leveled) before they are merged into the next one
+	BloomBitsPerKey			int		// 10 bits per key is ~1% false positives
+	BlockSize						int		// Bytes of records per data block, each block is checksummed and has a sparse index entry
+	BlockRestartInterval	int	// Records between restart points, the keys in between only store what differs from the previous one
+	BlockCacheSize			int64	// Bytes of data blocks kept in memory, shared by every SSTable of the store
+	LevelCompression		[]Compression	// Block codec per level, levels past the end use the last one
+	TargetFileSize			int64	// Bytes of data before a merge starts a new output SSTable
+
+	ValueThreshold			int		// Values of at least this many bytes go to the value log when flushed, negative keeps them all in the SSTables
+	ValueLogFileSize		int64	// Bytes of values before a new value log file is started
+
+	CompactionStyle			CompactionStyle
+	LevelBaseSize				int64	// Leveled: target bytes of L1
+	LevelSizeMultiplier	int		// Leveled: each level after L1 targets this many times the one above
+
+	L0SlowdownWrites		int		// Sorted runs in L0 before every write is delayed a bit
+	L0StopWrites				int		// Sorted runs in L0 before writes block until a merge catches up
+	CompactionWorkers		int		// Merges that can run at the same time on different levels or key ranges
+}
+
+func DefaultOptions() Options {
+	return Options{
+		Durability:						GroupCommit,
+		MemTableSize:					300, // Small max size ~8 lines
+		MaxLevels:						MAX_LEVEL,
+		MergeThreshold:				4, // Merge when Tier 0 has 4 segments
+		BloomBitsPerKey:			10,
+		BlockSize:						256, // Small like the memtable, ~16 records
+		BlockRestartInterval:	8,
+		BlockCacheSize:				1 << 20,
+		TargetFileSize:				2 << 10,
+		ValueThreshold:				1 << 10,
+		ValueLogFileSize:			64 << 10,
+		CompactionStyle:			SizeTiered,
+		LevelBaseSize:				4 << 10,
+		LevelSizeMultiplier:	10,
+		L0SlowdownWrites:			8,
+		L0StopWrites:					12,
+		CompactionWorkers:		2,
+	}
+}
+
+// Fills the zero fields with the defaults
+func (o Options) withDefaults() Options {
+	def := DefaultOptions()
+	if o.MemTableSize <= 0 {
+		o.MemTableSize = def.MemTableSize
+	}
+	if o.MaxLevels <= 0 {
+		o.MaxLevels = def.MaxLevels
+	}
+	if o.MergeThreshold < 2 {
+		o.MergeThreshold = def.MergeThreshold
+	}
+	if o.BloomBitsPerKey <= 0 {
+		o.BloomBitsPerKey = def.BloomBitsPerKey
+	}
+	if o.BlockSize <= 0 {
+		o.BlockSize = def.BlockSize
+	}
+	if o.BlockRestartInterval <= 0 {
+		o.BlockRestartInterval = def.BlockRestartInterval
+	}
+	if o.BlockCacheSize <= 0 {
+		o.BlockCacheSize = def.BlockCacheSize
+	}
+	// Light codec for the tiers that get rewritten often, the last one is compressed harder
+	if len(o.LevelCompression) == 0 {
+		o.LevelCompression = make([]Compression, o.MaxLevels+1)
+		for i := range o.LevelCompression {
+			o.LevelCompression[i] = SnappyCompression
+		}
+		o.LevelCompression[o.MaxLevels] = DeflateCompression
+	}
+	if o.TargetFileSize <= 0 {
+		o.TargetFileSize = def.TargetFileSize
+	}
+	if o.ValueThreshold == 0 {
+		o.ValueThreshold = def.ValueThreshold
+	}
+	if o.ValueLogFileSize <= 0 {
+		o.ValueLogFileSize = def.ValueLogFileSize
+	}
+	if o.LevelBaseSize <= 0 {
+		o.LevelBaseSize = def.LevelBaseSize
+	}
+	if o.CompactionWorkers <= 0 {
+		o.CompactionWorkers = def.CompactionWorkers
+	}
+	if o.LevelSizeMultiplier < 2 {
+		o.LevelSizeMultiplier = def.LevelSizeMultiplier
+	}
+	// Scaled with the merge threshold. L0 has to be allowed to reach it or it would never
+	// get merged and the writes would wait forever
+	if o.L0SlowdownWrites <= 0 {
+		o.L0SlowdownWrites = 2 * o.MergeThreshold
+	}
+	if o.L0StopWrites <= 0 {
+		o.L0StopWrites = 3 * o.MergeThreshold
+	}
+	if o.L0StopWrites <= o.MergeThreshold {
+		o.L0StopWrites = o.MergeThreshold + 1
+	}
+	return o
+}
+
+// Block codec of the SSTables written to level
+func (o Options) compressionFor(level int) Compression {
+	if len(o.LevelCompression) == 0 {
+		return NoCompression
+	}
+	if level >= len(o.LevelCompression) {
+		return o.LevelCompression[len(o.LevelCompression)-1]
+	}
+	return o.LevelCompression[level]
+}
@@ -0,0 +1,192 @@
+package v6
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Merges used to be queued on a channel after each flush and dropped when it was full,
+// nothing else started one so L0 could grow without bound. Now a request only wakes the
+// worker, which asks the strategy for merges until every tier is within its limits.
+// Requests made while a wake up is pending fold into it, and since the work is read from
+// the tiers (the manifest state) instead of the request nothing is lost
+//
+// CompactionWorkers workers share the wake ups. The merges they are running are kept in
+// lsm.running and the strategy never picks their SSTables again or a merge that conflicts
+// with them, so a long merge of the last tier doesn't hold back the L0 merges
+const (
+	// Wait before trying again after a failed merge
+	compactionRetryDelay = time.Second
+
+	// Delay of each write while L0 is over L0SlowdownWrites
+	writeSlowdownDelay = time.Millisecond
+)
+
+type CompactionStats struct {
+	PendingLevels	[]int						// Levels over their limit, waiting for a merge
+	Running				int							// Merges the workers are running
+	L0Runs				int
+	StalledWrites	uint64					// Writes that were slowed down or blocked by L0
+	StallTime			time.Duration
+	FailedMerges	uint64					// Background merges that failed and were retried
+	LastError			error						// Why the last one failed, nil if none did
+}
+
+// Wakes a merge worker, does nothing if a wake up is already pending
+func (lsm *LSMManager) scheduleCompaction() {
+	select {
+	case lsm.compactWake <- struct{}{}:
+	default:
+	}
+}
+
+func (lsm *LSMManager) mergerWorker() {
+	defer lsm.mergerDone.Done()
+
+	for {
+		select {
+		case <-lsm.stopMerger:
+			return
+		case <-lsm.compactWake:
+			if err := lsm.compactPending(); err != nil {
+				lsm.mergeFailed(err)
+				time.AfterFunc(compactionRetryDelay, lsm.scheduleCompaction)
+			}
+		}
+	}
+}
+
+// Records a failed background merge. Writes stalled on L0 would wait for a merge that
+// may never come, they are woken up to return the error until one succeeds
+func (lsm *LSMManager) mergeFailed(err error) {
+	lsm.mu.Lock()
+	defer lsm.mu.Unlock()
+
+	lsm.failedMerges++
+	lsm.lastMergeErr = err
+	lsm.mergeFailing = true
+	lsm.mergeFinished.Broadcast()
+}
+
+// Runs merges until the strategy has nothing left to pick, so a merge that fills the
+// next tier cascades into it. Other workers pick what they can next to it
+func (lsm *LSMManager) compactPending() error {
+	// Collect all segments to delete after the merges
+	toDelete := make([]*SSTableReader, 0)
+	defer func() {
+		for _, seg := range toDelete {
+			seg.Close()
+			os.Remove(seg.Path)
+		}
+	}()
+
+	for {
+		select {
+		case <-lsm.stopMerger:
+			return nil
+		default:
+		}
+
+		// A manual compaction is merging the tiers, it wakes us up when it's done
+		lsm.mu.Lock()
+		if lsm.manualCompactions > 0 {
+			lsm.mu.Unlock()
+			return nil
+		}
+		c := lsm.strategy.Pick(lsm.tiers, lsm.running)
+		if c != nil {
+			lsm.running = append(lsm.running, c)
+		}
+		lsm.mu.Unlock()
+		if c == nil {
+			return nil
+		}
+
+		// An idle worker can take the next merge if it doesn't conflict with this one
+		lsm.scheduleCompaction()
+
+		err := lsm.runMergeCycle(c, &toDelete)
+		lsm.mu.Lock()
+		lsm.finishMerge(c, err)
+		lsm.mu.Unlock()
+		if err != nil {
+			return fmt.Errorf("merge of %d SSTables from L%d into L%d: %w", len(c.segments()), c.Level, c.Target, err)
+		}
+	}
+}
+
+// Takes the merge out of the running ones, its SSTables can be picked again if it failed.
+// Expects lsm.mu held
+func (lsm *LSMManager) finishMerge(c *Compaction, err error) {
+	for i, r := range lsm.running {
+		if r == c {
+			lsm.running = append(lsm.running[:i], lsm.running[i+1:]...)
+			break
+		}
+	}
+	if err == nil {
+		lsm.mergeFailing = false
+	}
+	// Writes stalled on L0 can go on
+	lsm.mergeFinished.Broadcast()
+}
+
+// Sorted runs in L0, what reads have to go through. Expects lsm.mu held
+func (lsm *LSMManager) l0Runs() int {
+	if len(lsm.tiers) == 0 {
+		return 0
+	}
+	return sortedRuns(lsm.tiers[0].Segments)
+}
+
+// Backpressure for writes, called before the store takes its lock. From L0SlowdownWrites
+// runs in L0 every write is delayed a bit, from L0StopWrites writes block until a merge
+// brings L0 back under it, so flushes can't outrun the merges. While merges keep failing
+// nothing will bring it down, so those writes return the last merge error instead
+func (lsm *LSMManager) throttleWrite() error {
+	lsm.mu.RLock()
+	runs, closed := lsm.l0Runs(), lsm.closed
+	lsm.mu.RUnlock()
+	if closed {
+		return ErrClosed
+	}
+	if runs < lsm.opts.L0SlowdownWrites {
+		return nil
+	}
+
+	start := time.Now()
+	if runs < lsm.opts.L0StopWrites {
+		time.Sleep(writeSlowdownDelay)
+	}
+
+	lsm.mu.Lock()
+	defer lsm.mu.Unlock()
+	for !lsm.closed && !lsm.mergeFailing && lsm.l0Runs() >= lsm.opts.L0StopWrites {
+		lsm.mergeFinished.Wait()
+	}
+	lsm.stalledWrites++
+	lsm.stallTime += time.Since(start)
+	if lsm.closed {
+		return ErrClosed
+	}
+	if lsm.mergeFailing && lsm.l0Runs() >= lsm.opts.L0StopWrites {
+		return fmt.Errorf("writes stopped with %d sorted runs in L0: %w", lsm.l0Runs(), lsm.lastMergeErr)
+	}
+	return nil
+}
+
+func (lsm *LSMManager) compactionStats() CompactionStats {
+	lsm.mu.RLock()
+	defer lsm.mu.RUnlock()
+
+	return CompactionStats{
+		PendingLevels:	lsm.strategy.Pending(lsm.tiers),
+		Running:				len(lsm.running),
+		L0Runs:					lsm.l0Runs(),
+		StalledWrites:	lsm.stalledWrites,
+		StallTime:			lsm.stallTime,
+		FailedMerges:		lsm.failedMerges,
+		LastError:			lsm.lastMergeErr,
+	}
+}
@@ -0,0 +1,60 @@
+package v6
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Manager without merge workers, L0 has runs overlapping SSTables and is at L0StopWrites
+func newStalledManager(runs int) *LSMManager {
+	lsm := &LSMManager{opts: Options{L0SlowdownWrites: runs, L0StopWrites: runs}}
+	lsm.mergeFinished = sync.NewCond(&lsm.mu)
+
+	tier := Tier{Level: 0}
+	for i := 0; i < runs; i++ {
+		tier.Segments = append(tier.Segments, &SSTableReader{minKey: []byte("a"), maxKey: []byte("z")})
+	}
+	lsm.tiers = append(lsm.tiers, tier)
+	return lsm
+}
+
+func TestThrottleWriteReturnsFailedMergeError(t *testing.T) {
+	lsm := newStalledManager(3)
+
+	result := make(chan error, 1)
+	go func() {
+		result <- lsm.throttleWrite()
+	}()
+
+	select {
+	case err := <-result:
+		t.Fatalf("expected the write to stall, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	mergeErr := errors.New("disk full")
+	lsm.mergeFailed(mergeErr)
+
+	select {
+	case err := <-result:
+		if !errors.Is(err, mergeErr) {
+			t.Fatalf("expected the merge error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the stalled write never returned after the merge failed")
+	}
+
+	// Later writes don't wait either until a merge succeeds
+	if err := lsm.throttleWrite(); !errors.Is(err, mergeErr) {
+		t.Fatalf("expected the merge error, got %v", err)
+	}
+	lsm.mu.Lock()
+	lsm.finishMerge(&Compaction{}, nil)
+	lsm.tiers[0].Segments = lsm.tiers[0].Segments[:1]
+	lsm.mu.Unlock()
+	if err := lsm.throttleWrite(); err != nil {
+		t.Fatalf("expected writes to go on after a merge succeeded, got %v", err)
+	}
+}
@@ -2,7 +2,6 @@ package v6
 
 import (
 	"bytes"
-	"errors"
 	"math"
 	_ "unsafe"
 )
@@ -17,10 +16,15 @@ var probabilities [MaxHeight]uint32
 //go:linkname fastrandUint32 runtime.fastrand
 func fastrandUint32() uint32
 
+// Nodes are ordered by key, and by sequence number from newest to oldest for the same key
+// so every version of a key written after a snapshot can live next to the one it sees
 type Node struct {
 	Key		[]byte
 	Value	[]byte
-	Tower	[]*Node
+	Kind			byte	// KindPut or KindDelete (tombstone)
+	Seq				uint64
+	ExpiresAt	int64	// Unix nanoseconds, 0 never expires
+	Tower			[]*Node
 }
 
 type SkipList struct {
@@ -68,17 +72,31 @@ func randomHeight() int {
 	return height
 }
 
-// Returns node with the exact key match
+// Position of (key, seq) relative to the node: key ascending, seq descending
+func compareNode(key []byte, seq uint64, nd *Node) int {
+	if cmp := bytes.Compare(key, nd.Key); cmp != 0 {
+		return cmp
+	}
+	switch {
+	case seq > nd.Seq:
+		return -1
+	case seq < nd.Seq:
+		return 1
+	}
+	return 0
+}
+
+// Returns the first node at or after (k, seq), and the last node before it on every level
 // We search by comparing nodes, if the key is greater, we keep advancing nodes.
 // If the key is smaller or equal, we go down a level. Repeat until we find the key.
-func (sl *SkipList) search(k []byte) (*Node, [MaxHeight]*Node) {
+func (sl *SkipList) search(k []byte, seq uint64) (*Node, [MaxHeight]*Node) {
 	var next *Node
 	var journey [MaxHeight]*Node
 
 	prev := sl.Head // We start at the head of the list
 	for level := sl.Height - 1; level >= 0; level-- {
 		for next = prev.Tower[level]; next != nil; next = prev.Tower[level] {
-			if bytes.Compare(k, next.Key) <= 0 {
+			if compareNode(k, seq, next) <= 0 {
 				break
 			}
 			prev = next
@@ -86,50 +104,71 @@ func (sl *SkipList) search(k []byte) (*Node, [MaxHeight]*Node) {
 		journey[level] = prev
 	}
 
-	if next != nil && bytes.Equal(k, next.Key) {
-		return next, journey
-	}
-	return nil, journey
+	return next, journey
 }
 
 // searchGE finds first key >= target for seeks and range queries
 func (sl *SkipList) searchGE(target []byte) *Node {
-	var next *Node
-	prev := sl.Head
-	
-	for level := sl.Height - 1; level >= 0; level-- {
-		for next = prev.Tower[level]; next != nil; next = prev.Tower[level] {
-			if bytes.Compare(next.Key, target) >= 0 {
-				break
-			}
-			prev = next
-		}
-	}
-	
+	next, _ := sl.search(target, math.MaxUint64)
 	return next
 }
 
+// Returns the newest value of the key
 func (sl *SkipList) Find(key []byte) ([]byte, error) {
-	found, _ := sl.search(key)
+	value, kind, found := sl.Lookup(key)
+	if !found || kind == KindDelete {
+		return nil, ErrNotFound
+	}
+	return value, nil
+}
 
-	if found == nil {
-		return nil, errors.New("key not found")
+// Returns the value and kind of the newest version of the key, tombstones are found too
+func (sl *SkipList) Lookup(key []byte) ([]byte, byte, bool) {
+	nd := sl.LookupAt(key, math.MaxUint64)
+	if nd == nil {
+		return nil, 0, false
 	}
+	return nd.Value, nd.Kind, true
+}
 
-	return found.Value, nil
+// Returns the newest version of the key with a sequence number <= seq
+func (sl *SkipList) LookupAt(key []byte, seq uint64) *Node {
+	next, _ := sl.search(key, seq)
+	if next != nil && bytes.Equal(next.Key, key) {
+		return next
+	}
+	return nil
 }
 
-func (sl *SkipList) Insert(key []byte, val []byte) {
+func (sl *SkipList) Insert(key []byte, val []byte, seq uint64) {
+	sl.insert(key, val, KindPut, seq, 0)
+}
+
+// Same as Insert, the version hides the key once expiresAt (unix nanoseconds) has passed
+func (sl *SkipList) InsertExpiring(key []byte, val []byte, seq uint64, expiresAt int64) {
+	sl.insert(key, val, KindPut, seq, expiresAt)
+}
+
+// Tombstones are kept as nodes so they hide older versions of the key in SSTables
+func (sl *SkipList) InsertTombstone(key []byte, seq uint64) {
+	sl.insert(key, nil, KindDelete, seq, 0)
+}
+
+// Every sequence number is a new version, older versions stay for snapshots
+// until the memtable is flushed
+func (sl *SkipList) insert(key []byte, val []byte, kind byte, seq uint64, expiresAt int64) {
 	keyCopy := make([]byte, len(key))
 	copy(keyCopy, key)
 	valCopy := make([]byte, len(val))
 	copy(valCopy, val)
 
-	found, journey := sl.search(keyCopy)
+	found, journey := sl.search(keyCopy, seq)
 
-	// If it exists update the value of the key
-	if found != nil {
+	// Same version (e.g. two old tables without sequence numbers), the newer write wins
+	if found != nil && compareNode(keyCopy, seq, found) == 0 {
 		found.Value = valCopy
+		found.Kind = kind
+		found.ExpiresAt = expiresAt
 		return
 	}
 
@@ -137,6 +176,9 @@ func (sl *SkipList) Insert(key []byte, val []byte) {
 	nd := &Node{
 		Key: keyCopy,
 		Value: valCopy,
+		Kind: kind,
+		Seq: seq,
+		ExpiresAt: expiresAt,
 		Tower: make([]*Node, height),
 	}
 
@@ -158,10 +200,11 @@ func (sl *SkipList) Insert(key []byte, val []byte) {
 	}
 }
 
+// Unlinks the newest version of the key
 func (sl *SkipList) Delete(key []byte) bool {
-	found, journey := sl.search(key)
+	found, journey := sl.search(key, math.MaxUint64)
 
-	if found == nil {
+	if found == nil || !bytes.Equal(found.Key, key) {
 		return false
 	}
 
@@ -219,6 +262,30 @@ func (it *Iterator) Value() []byte {
 	return it.current.Value
 }
 
+// Returns the kind of the record at the iterators position
+func (it *Iterator) Kind() byte {
+	if !it.Valid() {
+		return 0
+	}
+	return it.current.Kind
+}
+
+// Returns the sequence number of the record at the iterators position
+func (it *Iterator) Seq() uint64 {
+	if !it.Valid() {
+		return 0
+	}
+	return it.current.Seq
+}
+
+// Returns the expiry of the record at the iterators position, 0 if it never expires
+func (it *Iterator) ExpiresAt() int64 {
+	if !it.Valid() {
+		return 0
+	}
+	return it.current.ExpiresAt
+}
+
 func (it *Iterator) Seek(target []byte) bool {
 	node := it.skiplist.searchGE(target)
 	if node != nil {
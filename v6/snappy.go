@@ -0,0 +1,175 @@
+package v6
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Snappy block format, written here so the store doesn't need any dependency.
+// [uncompressed length uvarint] followed by elements, the low 2 bits of the tag byte say which:
+//
+//	literal: length-1 in the upper 6 bits, or 60-63 there and the length-1 in the next 1-4 bytes, then the bytes
+//	copy1:   length-4 in bits 2-4, offset bits 8-10 in bits 5-7 and the low 8 bits in the next byte
+//	copy2:   length-1 in the upper 6 bits, 2 byte little endian offset
+//	copy4:   length-1 in the upper 6 bits, 4 byte little endian offset (only decoded, we never write them)
+//
+// A copy repeats length bytes starting offset bytes back in the output, it can overlap itself.
+// The encoder is greedy: a hash table of the last position of every 4 byte sequence finds a
+// match, it's extended as far as it goes. It doesn't compress as well as the real thing but
+// it's fast and blocks are small
+const (
+	snappyTagLiteral	= 0x00
+	snappyTagCopy1		= 0x01
+	snappyTagCopy2		= 0x02
+	snappyTagCopy4		= 0x03
+
+	snappyHashBits		= 12
+	snappyMaxOffset		= 1<<16 - 1
+)
+
+var errSnappyCorrupt = errors.New("corrupt snappy block")
+
+func snappyEncode(dst, src []byte) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(src)))
+
+	// Positions + 1, 0 means nothing seen yet
+	var table [1 << snappyHashBits]int32
+	literal := 0
+	for i := 0; i+4 <= len(src); {
+		h := snappyHash(binary.LittleEndian.Uint32(src[i:]))
+		candidate := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if candidate < 0 || i-candidate > snappyMaxOffset ||
+			binary.LittleEndian.Uint32(src[candidate:]) != binary.LittleEndian.Uint32(src[i:]) {
+			i++
+			continue
+		}
+
+		length := 4
+		for i+length < len(src) && src[candidate+length] == src[i+length] {
+			length++
+		}
+		dst = snappyLiteral(dst, src[literal:i])
+		dst = snappyCopy(dst, i-candidate, length)
+		i += length
+		literal = i
+	}
+	return snappyLiteral(dst, src[literal:])
+}
+
+func snappyHash(u uint32) uint32 {
+	return (u * 0x1e35a7bd) >> (32 - snappyHashBits)
+}
+
+func snappyLiteral(dst, literal []byte) []byte {
+	if len(literal) == 0 {
+		return dst
+	}
+	n := len(literal) - 1
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2|snappyTagLiteral)
+	case n < 1<<8:
+		dst = append(dst, 60<<2|snappyTagLiteral, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2|snappyTagLiteral, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2|snappyTagLiteral, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2|snappyTagLiteral, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, literal...)
+}
+
+// Copies longer than 64 bytes are split, leaving at least 4 bytes for the last one
+func snappyCopy(dst []byte, offset, length int) []byte {
+	for length >= 68 {
+		dst = append(dst, 63<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+		length -= 64
+	}
+	if length > 64 {
+		dst = append(dst, 59<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+		length -= 60
+	}
+	if length <= 11 && offset < 1<<11 {
+		return append(dst, byte(offset>>8)<<5|byte(length-4)<<2|snappyTagCopy1, byte(offset))
+	}
+	return append(dst, byte(length-1)<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+}
+
+func snappyDecode(src []byte) ([]byte, error) {
+	n, size := binary.Uvarint(src)
+	// A copy element can't expand to more than 64 bytes per 2 bytes of input
+	if size <= 0 || n > 32*uint64(len(src)) {
+		return nil, errSnappyCorrupt
+	}
+	dst := make([]byte, 0, n)
+	src = src[size:]
+
+	for len(src) > 0 {
+		tag := src[0]
+		var length, offset int
+
+		switch tag & 0x03 {
+		case snappyTagLiteral:
+			length = int(tag >> 2)
+			src = src[1:]
+			if length >= 60 {
+				extra := length - 59
+				if len(src) < extra {
+					return nil, errSnappyCorrupt
+				}
+				length = 0
+				for i := extra - 1; i >= 0; i-- {
+					length = length<<8 | int(src[i])
+				}
+				src = src[extra:]
+			}
+			length++
+			if length > len(src) || uint64(length) > n-uint64(len(dst)) {
+				return nil, errSnappyCorrupt
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+			continue
+
+		case snappyTagCopy1:
+			if len(src) < 2 {
+				return nil, errSnappyCorrupt
+			}
+			length = int(tag>>2&0x07) + 4
+			offset = int(tag>>5)<<8 | int(src[1])
+			src = src[2:]
+
+		case snappyTagCopy2:
+			if len(src) < 3 {
+				return nil, errSnappyCorrupt
+			}
+			length = int(tag>>2) + 1
+			offset = int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+
+		case snappyTagCopy4:
+			if len(src) < 5 {
+				return nil, errSnappyCorrupt
+			}
+			length = int(tag>>2) + 1
+			offset = int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+		}
+
+		if offset <= 0 || offset > len(dst) || uint64(length) > n-uint64(len(dst)) {
+			return nil, errSnappyCorrupt
+		}
+		// Byte by byte, the copy can overlap what it's writing
+		start := len(dst) - offset
+		for i := 0; i < length; i++ {
+			dst = append(dst, dst[start+i])
+		}
+	}
+
+	if uint64(len(dst)) != n {
+		return nil, errSnappyCorrupt
+	}
+	return dst, nil
+}
@@ -0,0 +1,122 @@
+package v6
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func snappyRoundTrip(t *testing.T, name string, src []byte) []byte {
+	t.Helper()
+
+	encoded := snappyEncode(nil, src)
+	decoded, err := snappyDecode(encoded)
+	if err != nil {
+		t.Fatalf("%s: decode failed: %v", name, err)
+	}
+	if !bytes.Equal(decoded, src) {
+		t.Fatalf("%s: round trip changed the data (%d bytes in, %d out)", name, len(src), len(decoded))
+	}
+	return encoded
+}
+
+func TestSnappyRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := make([]byte, 100_000)
+	rng.Read(random)
+
+	var keys []byte
+	for i := 0; i < 2000; i++ {
+		keys = fmt.Appendf(keys, "user:%06d:name", i)
+	}
+
+	tests := []struct {
+		name	string
+		src		[]byte
+	}{
+		{"empty", nil},
+		{"one byte", []byte("a")},
+		{"shorter than a match", []byte("abc")},
+		{"incompressible", random},
+		{"repeated byte", bytes.Repeat([]byte("a"), 100_000)},
+		{"repeated pattern", bytes.Repeat([]byte("abc"), 10_000)},
+		{"sorted keys", keys},
+		// Matches further back than snappyMaxOffset can't be used, the data is literals again
+		{"repeats past the max offset", append(append([]byte(nil), random[:70_000]...), random[:70_000]...)},
+	}
+	for _, tt := range tests {
+		snappyRoundTrip(t, tt.name, tt.src)
+	}
+
+	// Data that doesn't compress only gets the length header and the literal tags added
+	if encoded := snappyRoundTrip(t, "incompressible", random); len(encoded) > len(random)+16 {
+		t.Errorf("incompressible data grew from %d to %d bytes", len(random), len(encoded))
+	}
+	if encoded := snappyRoundTrip(t, "repeated byte", bytes.Repeat([]byte("a"), 100_000)); len(encoded) > 100_000/20 {
+		t.Errorf("100000 repeated bytes compressed to %d bytes", len(encoded))
+	}
+}
+
+func TestSnappyDecodeOverlappingCopy(t *testing.T) {
+	// "ab" then a copy of 10 bytes from 2 back, it reads the bytes it's writing
+	src := binary.AppendUvarint(nil, 12)
+	src = append(src, 1<<2|snappyTagLiteral, 'a', 'b')
+	src = append(src, (10-4)<<2|snappyTagCopy1, 2)
+
+	got, err := snappyDecode(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "abababababab" {
+		t.Errorf("expected abababababab, got %q", got)
+	}
+}
+
+func TestSnappyDecodeTruncated(t *testing.T) {
+	var src []byte
+	for i := 0; i < 200; i++ {
+		src = fmt.Appendf(src, "key%04d:value%d;", i, i%7)
+	}
+	encoded := snappyEncode(nil, src)
+
+	for n := 0; n < len(encoded); n++ {
+		if _, err := snappyDecode(encoded[:n]); err == nil {
+			t.Fatalf("expected an error for the first %d of %d bytes", n, len(encoded))
+		}
+	}
+}
+
+func TestSnappyDecodeCorrupt(t *testing.T) {
+	header := func(n int) []byte { return binary.AppendUvarint(nil, uint64(n)) }
+
+	tests := []struct {
+		name	string
+		src		[]byte
+	}{
+		{"copy before any output", append(header(4), 0<<2|snappyTagCopy1, 1)},
+		{"copy with offset 0", append(header(5), 0<<2|snappyTagLiteral, 'a', 0<<2|snappyTagCopy1, 0)},
+		{"copy past the start", append(header(6), 0<<2|snappyTagLiteral, 'a', 1<<2|snappyTagCopy2, 2, 0)},
+		{"literal longer than the header", append(header(1), 1<<2|snappyTagLiteral, 'a', 'b')},
+		{"copy longer than the header", append(header(3), 0<<2|snappyTagLiteral, 'a', 3<<2|snappyTagCopy2, 1, 0)},
+		{"literal past the input", append(header(10), 9<<2|snappyTagLiteral, 'a')},
+		{"length header far past the input", append(header(1<<30), 0<<2|snappyTagLiteral, 'a')},
+		{"copy4 cut short", append(header(8), 0<<2|snappyTagLiteral, 'a', 3<<2|snappyTagCopy4, 1, 0)},
+		{"output shorter than the header", append(header(3), 0<<2|snappyTagLiteral, 'a')},
+	}
+	for _, tt := range tests {
+		if _, err := snappyDecode(tt.src); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+
+	// Random damage can decode to the wrong bytes (blocks have a checksum for that) but must not panic
+	rng := rand.New(rand.NewSource(1))
+	encoded := snappyEncode(nil, bytes.Repeat([]byte("user:0001 user:0002 "), 50))
+	for i := 0; i < 10_000; i++ {
+		damaged := append([]byte(nil), encoded...)
+		damaged[rng.Intn(len(damaged))] ^= byte(1 + rng.Intn(255))
+		snappyDecode(damaged)
+	}
+}
@@ -0,0 +1,169 @@
+package v6
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+)
+
+// Point in time view of the store. Reads only see writes with a sequence number <= Seq(),
+// flushes and merges keep the versions it needs until it's released
+//
+//	snap, _ := store.Snapshot()
+//	defer snap.Release()
+//	v, err := snap.Get("balance:alice")
+type Snapshot struct {
+	store			*V6Store
+	seq				uint64
+	mu				sync.Mutex
+	released	bool
+}
+
+func (snap *Snapshot) Seq() uint64 {
+	return snap.seq
+}
+
+func (snap *Snapshot) Get(key string) (string, error) {
+	if snap.isReleased() {
+		return "", ErrClosed
+	}
+	return snap.store.getAt(key, snap.seq)
+}
+
+func (snap *Snapshot) Scan(start, end string) (*ScanIterator, error) {
+	if snap.isReleased() {
+		return nil, ErrClosed
+	}
+	var endKey []byte
+	if end != "" {
+		endKey = []byte(end)
+	}
+	return snap.store.scanAt([]byte(start), endKey, snap.seq)
+}
+
+func (snap *Snapshot) ScanPrefix(prefix string) (*ScanIterator, error) {
+	if snap.isReleased() {
+		return nil, ErrClosed
+	}
+	return snap.store.scanAt([]byte(prefix), prefixEnd([]byte(prefix)), snap.seq)
+}
+
+// Lets merges drop the versions only this snapshot could see. Safe to call more than once
+func (snap *Snapshot) Release() {
+	snap.mu.Lock()
+	defer snap.mu.Unlock()
+
+	if snap.released {
+		return
+	}
+	snap.released = true
+	snap.store.snapshots.release(snap.seq)
+}
+
+func (snap *Snapshot) isReleased() bool {
+	snap.mu.Lock()
+	defer snap.mu.Unlock()
+
+	return snap.released
+}
+
+// Sequence numbers of the live snapshots, shared by the store and the LSM manager
+type snapshotList struct {
+	mu		sync.Mutex
+	refs	map[uint64]int
+}
+
+func newSnapshotList() *snapshotList {
+	return &snapshotList{refs: make(map[uint64]int)}
+}
+
+func (l *snapshotList) acquire(seq uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refs[seq]++
+}
+
+func (l *snapshotList) release(seq uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refs[seq]--
+	if l.refs[seq] <= 0 {
+		delete(l.refs, seq)
+	}
+}
+
+// Live snapshot sequence numbers, ascending
+func (l *snapshotList) sorted() []uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	seqs := make([]uint64, 0, len(l.refs))
+	for seq := range l.refs {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs
+}
+
+// Decides which versions survive a flush or a merge
+type retention struct {
+	snapshots				[]uint64	// Ascending
+	dropTombstones	bool			// Nothing older exists below us, tombstones only need to hide versions kept for snapshots
+	now							int64			// Puts that expired by now become tombstones, 0 keeps them as they are
+}
+
+func (r retention) filter() *versionFilter {
+	return &versionFilter{retention: r}
+}
+
+// Goes over the versions of each key (newest first) and keeps the newest one plus
+// the newest one each snapshot can see
+type versionFilter struct {
+	retention
+	key			[]byte
+	prevSeq	uint64
+	pending	[]kvEntry	// Kept versions of the current key
+}
+
+// Adds the next version in (key, seq desc) order, returns the kept versions of the
+// previous key once a new key starts
+func (f *versionFilter) add(entry kvEntry) []kvEntry {
+	// Nobody can read an expired value anymore, not even old snapshots. It still has to
+	// hide the older versions so it stays as a tombstone until the last level
+	if f.now != 0 && entry.expired(f.now) {
+		entry = kvEntry{Key: entry.Key, Kind: KindDelete, Seq: entry.Seq}
+	}
+
+	var done []kvEntry
+	if f.key == nil || !bytes.Equal(entry.Key, f.key) {
+		done = f.finish()
+		f.key = append([]byte{}, entry.Key...) // Not nil for the empty key, nil means no key yet
+		f.pending = append(f.pending, entry)
+		f.prevSeq = entry.Seq
+		return done
+	}
+
+	// Kept if a snapshot sees this version: seq <= snapshot < seq of the newer version
+	i := sort.Search(len(f.snapshots), func(i int) bool { return f.snapshots[i] >= entry.Seq })
+	if i < len(f.snapshots) && f.snapshots[i] < f.prevSeq {
+		f.pending = append(f.pending, entry)
+	}
+	f.prevSeq = entry.Seq
+	return done
+}
+
+// Returns the kept versions of the last key
+func (f *versionFilter) finish() []kvEntry {
+	kept := f.pending
+	if f.dropTombstones {
+		// The oldest versions being tombstones means there's nothing left to hide
+		for len(kept) > 0 && kept[len(kept)-1].Kind == KindDelete {
+			kept = kept[:len(kept)-1]
+		}
+	}
+	f.pending = nil
+	f.key = nil
+	return kept
+}
@@ -3,23 +3,76 @@ package v6
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"math"
 	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 )
 
+// SSTable formats, the magic is always the last 4 bytes of the file
+//
+//	SST1: plain text key:value lines, text index and text footer, "null" values are tombstones (read only)
+//	SST2: binary records with a kind, sequence number and expiry, grouped in blocks with prefix
+//	      compressed keys and restart points (see block.go). Every block is compressed on its own and
+//	      followed by a [codec][crc32c] trailer (see compression.go), the index size is the stored size.
+//	      Index, bloom, meta and footer are checksummed too
+const (
+	sstMagicV1 = "SST1"
+	sstMagic   = "SST2"
+
+	sstVersion1 = 1
+	sstVersion2 = 2
+
+	// SST1 tables wrote deletes as this value
+	legacyTombstone = "null"
+
+	// index, bloom and meta offsets/sizes (8 bytes each), their checksums, the footer's own checksum and the magic
+	footerSize = 6*8 + 4*4 + 4
+
+	// CRC32C at the end of every block
+	blockChecksumSize = 4
+	// The codec of the block goes before the checksum, which covers it too
+	blockTrailerSize = 1 + blockChecksumSize
+)
+
+// CRC32C (Castagnoli) table, shared by the SSTables and the WAL
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func checksum(data []byte) uint32 {
+	return crc32.Checksum(data, crcTable)
+}
+
+func crc32Update(crc uint32, data []byte) uint32 {
+	return crc32.Update(crc, crcTable, data)
+}
+
 type SSTableWriter struct {
 	file				*os.File
 	writer			*bufio.Writer
 	dataOffset	int64
-	index				[]IndexEntry
+	count				int
+	block				[]byte	// Records of the block being built
+	index				[]IndexEntry	// One entry per block
+	blockSize		int			// A new block is started once the current one has this many bytes
+	restarts		[]uint32	// Offsets of the restart points of the block being built
+	restartInterval	int		// Records between restart points
+	sinceRestart	int
+	lastKey			[]byte	// Key of the previous record, the next one only stores what differs from it
+	rawSize			int64		// Bytes the data would take without prefix or block compression
+	scratch			[]byte
+	compressor	blockCompressor
 	bloom				*BloomFilter
 	minKey			[]byte
 	maxKey			[]byte
+	maxSeq			uint64
 }
 
+// Sparse index entry. For SST2 tables Offset/Size point to a block (Size excludes the trailer)
 type IndexEntry struct {
 	Key    []byte
 	Offset int64
@@ -29,6 +82,8 @@ type IndexEntry struct {
 type SSTableReader struct {
 	Path         	string
 	file         	*os.File
+	version				int
+	dataEnd				int64
 	indexOffset  	int64
 	indexSize    	int64
 	bloomOffset  	int64
@@ -37,7 +92,12 @@ type SSTableReader struct {
 	bloom        	*BloomFilter
 	minKey       	[]byte
 	maxKey       	[]byte
+	maxSeq				uint64	// Highest sequence number, 0 for SST1 tables
+	rawDataSize		int64		// Bytes the data would take without prefix or block compression, dataEnd for SST1
+	size					int64		// File size, compaction strategies use it for level sizes
 	Id						int
+	cacheID				uint64				// Key of the table's blocks in the cache
+	cache					*blockCache		// Shared by the tables of a store, nil reads from the file every time
 }
 
 type FooterMetadata struct {
@@ -45,19 +105,25 @@ type FooterMetadata struct {
 	IndexSize   int64
 	BloomOffset int64
 	BloomSize   int64
+	MetaOffset  int64
+	MetaSize    int64
+	IndexCRC    uint32
+	BloomCRC    uint32
+	MetaCRC     uint32
 	Magic       string
 	MinKey      []byte
 	MaxKey      []byte
 }
 
-func NewSSTableWriter(path string, expectedKeys int) (*SSTableWriter, error) {
+// Level is where the table goes, it picks the block codec
+func NewSSTableWriter(path string, expectedKeys int, opts Options, level int) (*SSTableWriter, error) {
+	opts = opts.withDefaults()
 	file, err := os.Create(path)
 	if err != nil {
 		return nil, err
 	}
 
-	// 1% false positive rate
-	bloom := NewBloomFilter(expectedKeys, 0.01)
+	bloom := NewBloomFilterBitsPerKey(expectedKeys, opts.BloomBitsPerKey)
 
 	writer := bufio.NewWriter(file)
 
@@ -65,91 +131,170 @@ func NewSSTableWriter(path string, expectedKeys int) (*SSTableWriter, error) {
 		file:       file,
 		writer:     writer,
 		dataOffset: 0,
-		index:      make([]IndexEntry, 0, expectedKeys/100), // Sparse index
+		index:      make([]IndexEntry, 0), // Sparse index
+		blockSize:	opts.BlockSize,
+		restartInterval: opts.BlockRestartInterval,
+		compressor:	blockCompressor{codec: opts.compressionFor(level)},
 		bloom:      bloom,
 		minKey:     []byte{},
 		maxKey:     []byte{},
 	}, nil
 }
 
-// Keys to be added in sorted order
-func (w *SSTableWriter) Append(key, value []byte) error {
+// Keys to be added in sorted order (versions of the same key newest first),
+// tombstones are appended with KindDelete
+func (w *SSTableWriter) Append(entry kvEntry) error {
+	key, seq := entry.Key, entry.Seq
+
 	// Udate min and max keys
-	if len(w.minKey) == 0 {
+	if w.count == 0 {
 		w.minKey = append([]byte(nil), key...)
 	}
 	w.maxKey = append([]byte(nil), key...)
+	if seq > w.maxSeq {
+		w.maxSeq = seq
+	}
 
 	// Add the key to the bloom filter
 	w.bloom.Add(key)
 
-	// Plain text: key:value\n
-	line := fmt.Sprintf("%s:%s\n", string(key), string(value))
-	n, err := w.writer.WriteString(line)
-	if err != nil {
-		return err
-	}
-
-	// add to sparse index (every so often for more efficiency)
-	if len(w.index) == 0 || len(w.index)%16 == 0 {
+	// Blocks are cut by size, a record is never split so a block can end up a bit bigger.
+	// Every block gets a sparse index entry with its first key
+	if w.count == 0 || len(w.block) >= w.blockSize {
+		if err := w.finishBlock(); err != nil {
+			return err
+		}
 		w.index = append(w.index, IndexEntry{
 			Key:    append([]byte(nil), key...), // Copy key
 			Offset: w.dataOffset,
-			Size:   int64(n),
 		})
 	}
 
-	w.dataOffset += int64(n)
+	// Every restartInterval records the whole key is written, reads start from those
+	shared := 0
+	if len(w.block) == 0 || w.sinceRestart >= w.restartInterval {
+		w.restarts = append(w.restarts, uint32(len(w.block)))
+		w.sinceRestart = 0
+	} else {
+		shared = sharedPrefixLen(w.lastKey, key)
+	}
+	w.block = appendPrefixRecord(w.block, entry, shared)
+	w.lastKey = append(w.lastKey[:0], key...)
+	w.sinceRestart++
+
+	w.scratch = appendRecord(w.scratch[:0], entry)
+	w.rawSize += int64(len(w.scratch))
+
+	w.count++
+	return nil
+}
+
+func (w *SSTableWriter) AppendAll(entries []kvEntry) error {
+	for _, entry := range entries {
+		if err := w.Append(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Bytes of data blocks written so far, including the block being built
+func (w *SSTableWriter) DataSize() int64 {
+	return w.dataOffset + int64(len(w.block))
+}
+
+// Gives up on the table and removes the half written file
+func (w *SSTableWriter) Abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+// Compresses the buffered block with its restart points and writes it, followed by its codec and checksum
+func (w *SSTableWriter) finishBlock() error {
+	if len(w.block) == 0 {
+		return nil
+	}
+
+	for _, offset := range w.restarts {
+		w.block = binary.BigEndian.AppendUint32(w.block, offset)
+	}
+	w.block = binary.BigEndian.AppendUint32(w.block, uint32(len(w.restarts)))
+	w.restarts = w.restarts[:0]
+	w.rawSize += blockChecksumSize
+
+	codec, stored, err := w.compressor.compress(w.block)
+	if err != nil {
+		return fmt.Errorf("failed to compress block: %w", err)
+	}
+	trailer := []byte{byte(codec)}
+	trailer = binary.BigEndian.AppendUint32(trailer, crc32Update(checksum(stored), trailer))
+	if _, err := w.writer.Write(stored); err != nil {
+		return err
+	}
+	if _, err := w.writer.Write(trailer); err != nil {
+		return err
+	}
+
+	w.index[len(w.index)-1].Size = int64(len(stored))
+	w.dataOffset += int64(len(stored) + blockTrailerSize)
+	w.block = w.block[:0]
 	return nil
 }
 
 // SSTables have the index and bloom filters embedded in the same file, with a metadata footer to find those sections quickly
+// Layout: [data blocks][index][bloom][meta: min/max keys, max seq][footer]
 func (w *SSTableWriter) Finalize() error {
-	dataEnd := w.dataOffset
-	
-	// Ondex section marker
-	if _, err := w.writer.WriteString("\n--- INDEX ---\n"); err != nil {
+	if err := w.finishBlock(); err != nil {
 		return err
 	}
-	indexOffset := dataEnd + 15 // +15 for "\n--- INDEX ---\n"
-	indexSize := 0
 
-	// Write index
+	// Index section: [keyLen uvarint][key][offset uvarint][size uvarint] per entry
+	indexOffset := w.dataOffset
+	var indexData []byte
 	for _, entry := range w.index {
-		line := fmt.Sprintf("%s@%d:%d\n", string(entry.Key), entry.Offset, entry.Size)
-		n, err := w.writer.WriteString(line)
-		if err != nil {
-			return err
-		}
-		indexSize += n
+		indexData = binary.AppendUvarint(indexData, uint64(len(entry.Key)))
+		indexData = append(indexData, entry.Key...)
+		indexData = binary.AppendUvarint(indexData, uint64(entry.Offset))
+		indexData = binary.AppendUvarint(indexData, uint64(entry.Size))
 	}
-
-	// Bloom filter section marker
-	if _, err := w.writer.WriteString("\n--- BLOOM ---\n"); err != nil {
+	if _, err := w.writer.Write(indexData); err != nil {
 		return err
 	}
-	bloomOffset := indexOffset + int64(indexSize) + 15 // +15 for "\n--- BLOOM ---\n"
-	
+
 	// Bloom filter encoded
+	bloomOffset := indexOffset + int64(len(indexData))
 	bloomData := w.bloom.Marshal()
 	if _, err := w.writer.Write(bloomData); err != nil {
 		return err
 	}
-	bloomSize := len(bloomData)
-
-	// Footer with metadata
-	footer := fmt.Sprintf(
-		"\n--- FOOTER ---\n" +
-		"index_offset:%d\n" +
-		"index_size:%d\n" +
-		"bloom_offset:%d\n" +
-		"bloom_size:%d\n" +
-		"min_key:%s\n" +
-		"max_key:%s\n" +
-		"magic:SST1\n",
-		indexOffset, indexSize, bloomOffset, bloomSize, w.minKey, w.maxKey)
-	
-	if _, err := w.writer.WriteString(footer); err != nil {
+
+	// Meta section: [minKeyLen uvarint][minKey][maxKeyLen uvarint][maxKey][maxSeq uvarint][rawDataSize uvarint]
+	metaOffset := bloomOffset + int64(len(bloomData))
+	var metaData []byte
+	metaData = binary.AppendUvarint(metaData, uint64(len(w.minKey)))
+	metaData = append(metaData, w.minKey...)
+	metaData = binary.AppendUvarint(metaData, uint64(len(w.maxKey)))
+	metaData = append(metaData, w.maxKey...)
+	metaData = binary.AppendUvarint(metaData, w.maxSeq)
+	metaData = binary.AppendUvarint(metaData, uint64(w.rawSize))
+	if _, err := w.writer.Write(metaData); err != nil {
+		return err
+	}
+
+	// Fixed size footer so the reader can find it from the end of the file
+	footer := make([]byte, 0, footerSize)
+	footer = binary.BigEndian.AppendUint64(footer, uint64(indexOffset))
+	footer = binary.BigEndian.AppendUint64(footer, uint64(len(indexData)))
+	footer = binary.BigEndian.AppendUint64(footer, uint64(bloomOffset))
+	footer = binary.BigEndian.AppendUint64(footer, uint64(len(bloomData)))
+	footer = binary.BigEndian.AppendUint64(footer, uint64(metaOffset))
+	footer = binary.BigEndian.AppendUint64(footer, uint64(len(metaData)))
+	footer = binary.BigEndian.AppendUint32(footer, checksum(indexData))
+	footer = binary.BigEndian.AppendUint32(footer, checksum(bloomData))
+	footer = binary.BigEndian.AppendUint32(footer, checksum(metaData))
+	footer = binary.BigEndian.AppendUint32(footer, checksum(footer))
+	footer = append(footer, sstMagic...)
+	if _, err := w.writer.Write(footer); err != nil {
 		return err
 	}
 
@@ -165,8 +310,64 @@ func (w *SSTableWriter) Finalize() error {
 }
 
 func (w *SSTableWriter) Stats() string {
-	return fmt.Sprintf("Data: %d bytes, Index entries: %d, Bloom FPR: %.2f%%",
-		w.dataOffset, len(w.index), w.bloom.EstimatedFPR()*100)
+	return fmt.Sprintf("Data: %d bytes (%d without prefix or block compression), Index entries: %d, Bloom FPR: %.2f%%",
+		w.dataOffset, w.rawSize, len(w.index), w.bloom.EstimatedFPR()*100)
+}
+
+// Record without prefix compression: [kind][seq uvarint][expiresAt uvarint][keyLen uvarint][valueLen uvarint][key][value]
+// Only used to know what the data would take without it
+func appendRecord(dst []byte, entry kvEntry) []byte {
+	dst = append(dst, entry.Kind)
+	dst = binary.AppendUvarint(dst, entry.Seq)
+	dst = binary.AppendUvarint(dst, uint64(entry.ExpiresAt))
+	dst = binary.AppendUvarint(dst, uint64(len(entry.Key)))
+	dst = binary.AppendUvarint(dst, uint64(len(entry.Value)))
+	dst = append(dst, entry.Key...)
+	return append(dst, entry.Value...)
+}
+
+// Reads the next key:value line of an SST1 table. Returns io.EOF when there's no more records
+// Its records have sequence number 0, older than anything written since
+func readRecord(r *bufio.Reader) (kvEntry, error) {
+	key, value, err := readTextRecord(r)
+	return legacyEntry(key, value), err
+}
+
+// SST1 tables had no record kinds, a "null" value was the tombstone
+func legacyEntry(key, value []byte) kvEntry {
+	if string(value) == legacyTombstone {
+		return kvEntry{Key: key, Kind: KindDelete}
+	}
+	return kvEntry{Key: key, Value: value, Kind: KindPut}
+}
+
+func readTextRecord(r *bufio.Reader) ([]byte, []byte, error) {
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+
+		line = bytes.TrimSuffix(line, []byte("\n"))
+		if len(line) > 0 {
+			parts := bytes.SplitN(line, []byte(":"), 2)
+			if len(parts) == 2 {
+				return parts[0], parts[1], nil
+			}
+		}
+
+		if err == io.EOF {
+			return nil, nil, io.EOF
+		}
+	}
+}
+
+// A record cut in half is not a clean end of the data
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
 }
 
 func LoadSSTable(path string) (*SSTableReader, error) {
@@ -177,6 +378,7 @@ func LoadSSTable(path string) (*SSTableReader, error) {
 	
 	stat, err := file.Stat()
 	if err != nil {
+		file.Close()
 		return nil, err
 	}
 	
@@ -198,37 +400,120 @@ func LoadSSTable(path string) (*SSTableReader, error) {
 		return nil, fmt.Errorf("failed to read footer: %w", err)
 	}
 
-	footer, err := parseFooter(footerBytes)
-	if err != nil {
-		file.Close()
-		return nil, fmt.Errorf("failed to parse footer: %w", err)
-	}
-
 	reader := &SSTableReader{
 		Path: path,
 		file: file,
-		indexOffset: footer.IndexOffset,
-		indexSize: footer.IndexSize,
-		bloomOffset: footer.BloomOffset,
-		bloomSize: footer.BloomSize,
 		index: make([]IndexEntry, 0),
-		minKey: footer.MinKey,
-		maxKey: footer.MaxKey,
+		size: fileSize,
 	}
+	reader.Id, _ = parseSegmentID(filepath.Base(path))
+	reader.cacheID = nextTableID.Add(1)
 
-	if err := reader.loadBloomFilter(); err != nil {
+	var footer *FooterMetadata
+	if bytes.HasSuffix(footerBytes, []byte(sstMagicV1 + "\n")) {
+		footer, err = parseTextFooter(footerBytes)
+	} else {
+		footer, err = parseFooter(footerBytes)
+	}
+	if err != nil {
 		file.Close()
-		return nil, fmt.Errorf("failed to load bloom filter: %w", err)
+		return nil, &CorruptionError{Path: path, Offset: seekPos, Reason: fmt.Sprintf("failed to parse footer: %v", err)}
+	}
+
+	reader.indexOffset = footer.IndexOffset
+	reader.indexSize = footer.IndexSize
+	reader.bloomOffset = footer.BloomOffset
+	reader.bloomSize = footer.BloomSize
+
+	switch footer.Magic {
+	case sstMagicV1:
+		reader.version = sstVersion1
+		reader.dataEnd = footer.IndexOffset - 15 // "\n--- INDEX ---\n" marker
+		reader.minKey = footer.MinKey
+		reader.maxKey = footer.MaxKey
+	case sstMagic:
+		reader.version = sstVersion2
+		reader.dataEnd = footer.IndexOffset
 	}
+	reader.rawDataSize = reader.dataEnd
 
-	if err := reader.loadIndex(); err != nil {
+	if err := reader.loadSections(footer); err != nil {
 		file.Close()
-		return nil, fmt.Errorf("failed to load index: %w", err)
+		return nil, err
 	}
 	return reader, nil
 }
 
+func (r *SSTableReader) loadSections(footer *FooterMetadata) error {
+	if r.version >= sstVersion2 {
+		metaData, err := r.readSection("meta", footer.MetaOffset, footer.MetaSize, footer.MetaCRC)
+		if err != nil {
+			return err
+		}
+		if err := r.loadMeta(metaData); err != nil {
+			return &CorruptionError{Path: r.Path, Offset: footer.MetaOffset, Reason: err.Error()}
+		}
+	}
+
+	if r.bloomOffset != 0 && r.bloomSize != 0 {
+		bloomData, err := r.readSection("bloom filter", r.bloomOffset, r.bloomSize, footer.BloomCRC)
+		if err != nil {
+			return err
+		}
+		hash := bloomHashXX
+		if r.version == sstVersion1 {
+			hash = bloomHashFNV
+		}
+		r.bloom = UnmarshalBloomFilter(bloomData, hash)
+	}
+
+	if r.indexOffset != 0 && r.indexSize != 0 {
+		indexData, err := r.readSection("index", r.indexOffset, r.indexSize, footer.IndexCRC)
+		if err != nil {
+			return err
+		}
+		if err := r.loadIndex(indexData); err != nil {
+			return &CorruptionError{Path: r.Path, Offset: r.indexOffset, Reason: err.Error()}
+		}
+	}
+	return nil
+}
+
+// Binary footer, the last bytes of the file
 func parseFooter(data []byte) (*FooterMetadata, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("footer is too short")
+	}
+
+	magic := string(data[len(data)-4:])
+	if magic != sstMagic {
+		return nil, fmt.Errorf("invalid magic number: %q", magic)
+	}
+	if len(data) < footerSize {
+		return nil, fmt.Errorf("footer is too short")
+	}
+	footer := data[len(data)-footerSize:]
+
+	metadata := FooterMetadata{
+		IndexOffset: int64(binary.BigEndian.Uint64(footer[0:8])),
+		IndexSize:   int64(binary.BigEndian.Uint64(footer[8:16])),
+		BloomOffset: int64(binary.BigEndian.Uint64(footer[16:24])),
+		BloomSize:   int64(binary.BigEndian.Uint64(footer[24:32])),
+		MetaOffset:  int64(binary.BigEndian.Uint64(footer[32:40])),
+		MetaSize:    int64(binary.BigEndian.Uint64(footer[40:48])),
+		IndexCRC:    binary.BigEndian.Uint32(footer[48:52]),
+		BloomCRC:    binary.BigEndian.Uint32(footer[52:56]),
+		MetaCRC:     binary.BigEndian.Uint32(footer[56:60]),
+		Magic:       magic,
+	}
+	if checksum(footer[:60]) != binary.BigEndian.Uint32(footer[60:64]) {
+		return nil, fmt.Errorf("footer checksum mismatch")
+	}
+	return &metadata, nil
+}
+
+// Text footer used by SST1 tables
+func parseTextFooter(data []byte) (*FooterMetadata, error) {
 	footerMarker := []byte("\n--- FOOTER ---\n")
 	idx := bytes.Index(data, footerMarker)
 	if idx == -1 {
@@ -261,7 +546,7 @@ func parseFooter(data []byte) (*FooterMetadata, error) {
 			metadata.MaxKey = []byte(parts[1])
 		case "magic":
 			metadata.Magic = parts[1]
-			if metadata.Magic != "SST1" {
+			if metadata.Magic != sstMagicV1 {
 				return nil, fmt.Errorf("invalid magic number: %s", metadata.Magic)
 			}
 		}
@@ -269,37 +554,86 @@ func parseFooter(data []byte) (*FooterMetadata, error) {
 	return &metadata, nil
 }
 
-func (r *SSTableReader) loadBloomFilter() error {
-	if r.bloomOffset == 0 || r.bloomSize == 0 {
-		return nil
+// Reads a whole section of the file, checking its checksum on SST2 tables
+func (r *SSTableReader) readSection(name string, offset, size int64, crc uint32) ([]byte, error) {
+	data := make([]byte, size)
+	if _, err := r.file.ReadAt(data, offset); err != nil {
+		return nil, &CorruptionError{Path: r.Path, Offset: offset, Reason: fmt.Sprintf("failed to read %s: %v", name, err)}
 	}
-
-	if _, err := r.file.Seek(r.bloomOffset, io.SeekStart); err != nil {
-		return fmt.Errorf("failed to seek to bloom filter: %w", err)
+	if r.version >= sstVersion2 && checksum(data) != crc {
+		return nil, &CorruptionError{Path: r.Path, Offset: offset, Reason: name + " checksum mismatch"}
 	}
+	return data, nil
+}
 
-	bloomData := make([]byte, r.bloomSize)
-	if _, err := io.ReadFull(r.file, bloomData); err != nil {
-		return fmt.Errorf("failed to read bloom filter: %w", err)
+func (r *SSTableReader) loadMeta(metaData []byte) error {
+	var err error
+	buf := bytes.NewReader(metaData)
+	if r.minKey, err = readLengthPrefixed(buf); err != nil {
+		return fmt.Errorf("failed to read min key: %w", err)
+	}
+	if r.maxKey, err = readLengthPrefixed(buf); err != nil {
+		return fmt.Errorf("failed to read max key: %w", err)
+	}
+	if r.maxSeq, err = binary.ReadUvarint(buf); err != nil {
+		return fmt.Errorf("failed to read max sequence number: %w", err)
+	}
+	rawSize, err := binary.ReadUvarint(buf)
+	if err != nil {
+		return fmt.Errorf("failed to read raw data size: %w", err)
 	}
-	r.bloom = UnmarshalBloomFilter(bloomData)
+	r.rawDataSize = int64(rawSize)
 	return nil
 }
 
-func (r *SSTableReader) loadIndex() error {
-	if r.indexOffset == 0 || r.indexSize == 0 {
-		return nil
+func readLengthPrefixed(r *bytes.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(r.Len()) {
+		return nil, io.ErrUnexpectedEOF
 	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (r *SSTableReader) loadIndex(indexData []byte) error {
+	r.index = make([]IndexEntry, 0)
 
-	if _, err := r.file.Seek(r.indexOffset, io.SeekStart); err != nil {
-		return fmt.Errorf("failed to seek to index: %w", err)
+	if r.version == sstVersion1 {
+		r.loadTextIndex(indexData)
+		return nil
 	}
 
-	indexData := make([]byte, r.indexSize)
-	if _, err := io.ReadFull(r.file, indexData); err != nil {
-		return fmt.Errorf("failed to read index: %w", err)
+	buf := bytes.NewReader(indexData)
+	for buf.Len() > 0 {
+		key, err := readLengthPrefixed(buf)
+		if err != nil {
+			return err
+		}
+		offset, err := binary.ReadUvarint(buf)
+		if err != nil {
+			return err
+		}
+		size, err := binary.ReadUvarint(buf)
+		if err != nil {
+			return err
+		}
+		r.index = append(r.index, IndexEntry{
+			Key:    key,
+			Offset: int64(offset),
+			Size:   int64(size),
+		})
 	}
-	r.index = make([]IndexEntry, 0)
+	return nil
+}
+
+// SST1 index lines: key@offset:size
+func (r *SSTableReader) loadTextIndex(indexData []byte) {
 	scanner := bufio.NewScanner(bytes.NewReader(indexData))
 
 	for scanner.Scan() {
@@ -321,104 +655,314 @@ func (r *SSTableReader) loadIndex() error {
 			Size:   size,
 		})
 	}
-	return nil
 }
 
-func (r *SSTableReader) Get(key []byte) ([]byte, error) {
+// Returns the records of the span starting at index entry idx
+// SST2 blocks are read whole, their checksum verified and decompressed, the cache holds them decompressed.
+// SST1 tables just read up to the next index entry.
+// With cached the block comes from (and goes to) the block cache, merges read without it
+// so rewriting a tier doesn't push the hot blocks out
+func (r *SSTableReader) openBlock(file io.ReaderAt, idx int, cached bool) (*blockRecords, error) {
+	entry := r.index[idx]
+
+	if r.version == sstVersion1 {
+		endOffset := r.dataEnd
+		if idx+1 < len(r.index) {
+			endOffset = r.index[idx+1].Offset
+		}
+		return &blockRecords{reader: bufio.NewReader(io.NewSectionReader(file, entry.Offset, endOffset - entry.Offset))}, nil
+	}
+
+	cache := r.cache
+	if !cached {
+		cache = nil
+	}
+	key := blockKey{table: r.cacheID, offset: entry.Offset}
+	if cache != nil {
+		if data, ok := cache.get(key); ok {
+			return r.blockRecords(data, entry.Offset)
+		}
+	}
+
+	block := make([]byte, entry.Size + blockTrailerSize)
+	if _, err := file.ReadAt(block, entry.Offset); err != nil {
+		return nil, &CorruptionError{Path: r.Path, Offset: entry.Offset, Reason: fmt.Sprintf("failed to read block: %v", err)}
+	}
+	crcOffset := int64(len(block)) - blockChecksumSize
+	if checksum(block[:crcOffset]) != binary.BigEndian.Uint32(block[crcOffset:]) {
+		return nil, &CorruptionError{Path: r.Path, Offset: entry.Offset, Reason: "block checksum mismatch"}
+	}
+	data, err := decompressBlock(Compression(block[entry.Size]), block[:entry.Size])
+	if err != nil {
+		return nil, &CorruptionError{Path: r.Path, Offset: entry.Offset, Reason: fmt.Sprintf("failed to decompress block: %v", err)}
+	}
+	if cache != nil {
+		cache.add(key, data)
+	}
+	return r.blockRecords(data, entry.Offset)
+}
+
+// Records of a verified block
+func (r *SSTableReader) blockRecords(data []byte, offset int64) (*blockRecords, error) {
+	block, err := newPrefixBlock(data)
+	if err != nil {
+		return nil, &CorruptionError{Path: r.Path, Offset: offset, Reason: err.Error()}
+	}
+	return block, nil
+}
+
+// Reads the next record of a block, a truncated record is reported as corruption
+func (r *SSTableReader) nextRecord(block *blockRecords, idx int) (kvEntry, error) {
+	var entry kvEntry
+	var err error
+	if block.reader != nil {
+		entry, err = readRecord(block.reader)
+	} else {
+		entry, err = block.next()
+	}
+	if err != nil && err != io.EOF {
+		return kvEntry{}, &CorruptionError{Path: r.Path, Offset: r.index[idx].Offset, Reason: fmt.Sprintf("failed to read record: %v", err)}
+	}
+	return entry, err
+}
+
+// Returns the value and kind of the key, tombstones are returned with KindDelete
+// so the caller stops searching older tables
+func (r *SSTableReader) Get(key []byte) ([]byte, byte, error) {
+	return r.GetAt(key, math.MaxUint64)
+}
+
+// Same as Get, only sees versions with a sequence number <= seq
+func (r *SSTableReader) GetAt(key []byte, seq uint64) ([]byte, byte, error) {
+	entry, err := r.getEntry(key, seq)
+	if err != nil {
+		return nil, 0, err
+	}
+	return entry.Value, entry.Kind, nil
+}
+
+// Returns the newest record of the key with a sequence number <= seq
+func (r *SSTableReader) getEntry(key []byte, seq uint64) (kvEntry, error) {
 	// Range check
 	if bytes.Compare(key, r.minKey) < 0 || bytes.Compare(key, r.maxKey) > 0 {
-		return nil, fmt.Errorf("key is out of range")
+		return kvEntry{}, ErrNotFound
 	}
 
 	// Check bloom filter
 	if r.bloom != nil && !r.bloom.MayContain(key) {
-		return nil, fmt.Errorf("key not found")
+		return kvEntry{}, ErrNotFound
 	}
 
-	
-	// Search the nearest entry in the idx
+	if len(r.index) == 0 {
+		return kvEntry{}, ErrNotFound
+	}
+
+	// Search the nearest entry in the idx, versions of the key can start
+	// in the block before the first entry >= key
 	idx := sort.Search(len(r.index), func(i int) bool {
 		return bytes.Compare(r.index[i].Key, key) >= 0
 	})
+	if idx > 0 {
+		idx--
+	}
+
+	// Versions of a key can span several blocks, only the first one needs a seek
+	for first := idx; idx < len(r.index); idx++ {
+		block, err := r.openBlock(r.file, idx, true)
+		if err != nil {
+			return kvEntry{}, err
+		}
+		if idx == first {
+			if err := block.seek(key); err != nil {
+				return kvEntry{}, &CorruptionError{Path: r.Path, Offset: r.index[idx].Offset, Reason: err.Error()}
+			}
+		}
+		for {
+			entry, err := r.nextRecord(block, idx)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return kvEntry{}, err
+			}
+
+			cmp := bytes.Compare(entry.Key, key)
+			if cmp == 0 && entry.Seq <= seq {
+				return entry, nil
+			}
+
+			// If we passed it, it doesnt exist since the file is sorted
+			if cmp > 0 {
+				return kvEntry{}, ErrNotFound
+			}
+		}
+	}
+	return kvEntry{}, ErrNotFound
+}
+
+// Highest sequence number in the table
+func (r *SSTableReader) MaxSeq() uint64 {
+	return r.maxSeq
+}
+
+func (r *SSTableReader) Size() int64 {
+	return r.size
+}
+
+func (r *SSTableReader) MinKey() []byte {
+	return r.minKey
+}
 
-	// Sparse index navigation
-	if idx >= len(r.index) {
-		// Past the end, start from last entry
-		idx = len(r.index) - 1
+func (r *SSTableReader) MaxKey() []byte {
+	return r.maxKey
+}
+
+// Records in the table (every version counts), used to size the bloom filter of a merge
+func (r *SSTableReader) recordCount() int {
+	if r.bloom != nil {
+		return int(r.bloom.NumItems())
+	}
+	return len(r.index)
+}
+
+// True if the table can have keys in [start, end]
+func (r *SSTableReader) overlaps(start, end []byte) bool {
+	return bytes.Compare(r.minKey, end) <= 0 && bytes.Compare(start, r.maxKey) <= 0
+}
+
+func (r *SSTableReader) Close() error {
+	return r.file.Close()
+}
+
+// Sequential reader over the data section, used by range scans
+type SSTableIterator struct {
+	table		*SSTableReader
+	file		*os.File
+	blockIdx	int
+	block		*blockRecords
+	entry		kvEntry
+	pending	bool // The first record was already read while seeking
+	cached	bool // Read the blocks through the block cache
+	err			error
+}
+
+// Returns an iterator positioned right before the first key >= start
+// It opens its own file handle so a merge closing this reader doesn't break the scan
+func (r *SSTableReader) NewIterator(start []byte) (*SSTableIterator, error) {
+	return r.newIterator(start, true)
+}
+
+func (r *SSTableReader) newIterator(start []byte, cached bool) (*SSTableIterator, error) {
+	file, err := os.Open(r.Path)
+	if err != nil {
+		return nil, err
 	}
-	if idx > 0 && bytes.Compare(r.index[idx].Key, key) > 0 {
-		// Key is between index entries, go back one
+
+	// Jump to the sparse index entry before the first one >= start, the block
+	// before it can end with the newest versions of start
+	idx := sort.Search(len(r.index), func(i int) bool {
+		return bytes.Compare(r.index[i].Key, start) >= 0
+	})
+	if idx > 0 {
 		idx--
 	}
 
-	startOffset := r.index[idx].Offset
-	var endOffset int64
-	if idx+1 < len(r.index) {
-		endOffset = r.index[idx+1].Offset
-	} else {
-		endOffset = r.indexOffset
+	it := &SSTableIterator{
+		table:    r,
+		file:     file,
+		blockIdx: idx,
+		cached:		cached,
 	}
 
-	sr := io.NewSectionReader(r.file, startOffset, endOffset - startOffset)
-	scanner := bufio.NewScanner(sr)
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.SplitN(line, ":", 2)
-		if len(parts) != 2 {
-			continue
+	// Jump to the restart point before start inside the first block, then skip the keys before start
+	if idx < len(r.index) {
+		block, err := r.openBlock(file, idx, cached)
+		if err != nil {
+			file.Close()
+			return nil, err
 		}
-
-		if parts[0] == string(key) {
-			return []byte(parts[1]), nil
+		if err := block.seek(start); err != nil {
+			file.Close()
+			return nil, &CorruptionError{Path: r.Path, Offset: r.index[idx].Offset, Reason: err.Error()}
 		}
-
-		// If we passed it, it doesnt exist since the file is sorted
-		if parts[0] > string(key) {
+		it.block = block
+	}
+	for it.readNext() {
+		if bytes.Compare(it.entry.Key, start) >= 0 {
+			it.pending = true
 			break
 		}
 	}
-	return nil, fmt.Errorf("key not found")
+	if it.err != nil {
+		file.Close()
+		return nil, it.err
+	}
+	return it, nil
 }
 
-// Reads all KV pairs from the segment still reads the entire file line by line
-// this will be used when compacting segments after rotation
-func (r *SSTableReader) ReadAllRecords() (map[string][]byte, error) {
-	if _, err := r.file.Seek(0, io.SeekStart); err != nil {
-		return nil, fmt.Errorf("failed to seek to start: %w", err)
+func (it *SSTableIterator) Next() bool {
+	if it.pending {
+		it.pending = false
+		return true
 	}
+	return it.readNext()
+}
 
-	entries := make(map[string][]byte)
-	scanner := bufio.NewScanner(r.file)
-	
-	for scanner.Scan() {
-		line := scanner.Text()
-		
-		// Stop at index marker
-		if strings.HasPrefix(line, "\n--- INDEX ---") || strings.HasPrefix(line, "--- INDEX ---") {
-			break
+// Reads the next record, moving to the next block when the current one runs out
+func (it *SSTableIterator) readNext() bool {
+	for {
+		if it.block != nil {
+			entry, err := it.table.nextRecord(it.block, it.blockIdx)
+			if err == nil {
+				it.entry = entry
+				return true
+			}
+			if err != io.EOF {
+				it.err = err
+				return false
+			}
 		}
-		
-		// Skip empty lines
-		if line == "" {
-			continue
+
+		it.blockIdx++
+		if it.blockIdx >= len(it.table.index) {
+			it.block = nil
+			it.entry = kvEntry{}
+			return false
 		}
-		
-		// Parse key:value
-		parts := strings.SplitN(line, ":", 2)
-		if len(parts) != 2 {
-			continue
+
+		block, err := it.table.openBlock(it.file, it.blockIdx, it.cached)
+		if err != nil {
+			it.err = err
+			return false
 		}
-		
-		entries[parts[0]] = []byte(parts[1])
-	}
-	
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("error reading entries: %w", err)
+		it.block = block
 	}
-	
-	return entries, nil
 }
 
-func (r *SSTableReader) Close() error {
-	return r.file.Close()
-}
\ No newline at end of file
+func (it *SSTableIterator) Key() []byte {
+	return it.entry.Key
+}
+
+func (it *SSTableIterator) Value() []byte {
+	return it.entry.Value
+}
+
+func (it *SSTableIterator) Kind() byte {
+	return it.entry.Kind
+}
+
+func (it *SSTableIterator) Seq() uint64 {
+	return it.entry.Seq
+}
+
+func (it *SSTableIterator) ExpiresAt() int64 {
+	return it.entry.ExpiresAt
+}
+
+func (it *SSTableIterator) Err() error {
+	return it.err
+}
+
+func (it *SSTableIterator) Close() error {
+	return it.file.Close()
+}
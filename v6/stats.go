@@ -0,0 +1,84 @@
+package v6
+
+import (
+	"fmt"
+	"strings"
+)
+
+type LevelStats struct {
+	Level				int
+	Tables			int
+	DataSize		int64	// Bytes of the data blocks on disk
+	RawDataSize	int64	// What the same records would take without prefix or block compression
+	FileSize		int64
+}
+
+type StorageStats struct {
+	Levels					[]LevelStats
+	ValueLogFiles		int
+	ValueLogSize		int64		// Bytes of the value log files, dead values included until the GC runs
+}
+
+// Data bytes on disk and without prefix or block compression, over every level
+func (s StorageStats) Totals() (data, raw int64) {
+	for _, level := range s.Levels {
+		data += level.DataSize
+		raw += level.RawDataSize
+	}
+	return data, raw
+}
+
+func (lsm *LSMManager) storageStats() StorageStats {
+	lsm.mu.RLock()
+	defer lsm.mu.RUnlock()
+
+	var stats StorageStats
+	for _, tier := range lsm.tiers {
+		level := LevelStats{Level: tier.Level, Tables: len(tier.Segments)}
+		for _, seg := range tier.Segments {
+			level.DataSize += seg.dataEnd
+			level.RawDataSize += seg.rawDataSize
+			level.FileSize += seg.Size()
+		}
+		stats.Levels = append(stats.Levels, level)
+	}
+	stats.ValueLogFiles, stats.ValueLogSize = lsm.values.size()
+	return stats
+}
+
+// Saved share of the raw size, in percent
+func savedPercent(data, raw int64) float64 {
+	if raw == 0 {
+		return 0
+	}
+	return float64(raw-data) * 100 / float64(raw)
+}
+
+// Human readable summary of the SSTables, the block cache, the merges and the WAL replay
+func formatStats(storage StorageStats, cache BlockCacheStats, compaction CompactionStats, recovery WALReplayStats) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "%-6s %-7s %-12s %-12s %s\n", "Level", "Tables", "Data", "Raw data", "Saved")
+	for _, level := range storage.Levels {
+		fmt.Fprintf(&b, "L%-5d %-7d %-12d %-12d %.1f%%\n",
+			level.Level, level.Tables, level.DataSize, level.RawDataSize, savedPercent(level.DataSize, level.RawDataSize))
+	}
+	data, raw := storage.Totals()
+	fmt.Fprintf(&b, "Total data: %d bytes, %d bytes without prefix or block compression (%.1f%% smaller)\n", data, raw, savedPercent(data, raw))
+	fmt.Fprintf(&b, "Value log: %d files, %d bytes\n", storage.ValueLogFiles, storage.ValueLogSize)
+
+	lookups := cache.Hits + cache.Misses
+	hitRate := 0.0
+	if lookups > 0 {
+		hitRate = float64(cache.Hits) * 100 / float64(lookups)
+	}
+	fmt.Fprintf(&b, "Block cache: %d blocks, %d/%d bytes, %d hits, %d misses (%.1f%% hit rate)\n",
+		cache.Blocks, cache.Size, cache.Capacity, cache.Hits, cache.Misses, hitRate)
+	fmt.Fprintf(&b, "Compaction: %d running, pending levels %v, %d L0 runs, %d stalled writes (%v), %d failed merges\n",
+		compaction.Running, compaction.PendingLevels, compaction.L0Runs, compaction.StalledWrites, compaction.StallTime, compaction.FailedMerges)
+	if compaction.LastError != nil {
+		fmt.Fprintf(&b, "Last merge error: %v\n", compaction.LastError)
+	}
+	fmt.Fprintf(&b, "WAL recovery: %d entries, %d bytes of a torn entry dropped", recovery.Records, recovery.TruncatedBytes)
+	return b.String()
+}
@@ -0,0 +1,108 @@
+package v6
+
+import (
+	"fmt"
+)
+
+// Optimistic read-modify-write transaction. Reads come from a snapshot taken by Begin,
+// writes are buffered and applied as one batch by Commit. Commit fails with ErrConflict
+// if another writer changed a key the transaction read, the caller can retry from Begin.
+// A Txn is not safe for concurrent use
+//
+//	txn, _ := store.Begin()
+//	v, _ := txn.Get("counter")
+//	n, _ := strconv.Atoi(v)
+//	txn.Set("counter", strconv.Itoa(n+1))
+//	err := txn.Commit()
+type Txn struct {
+	store		*V6Store
+	snap		*Snapshot
+	writes	*WriteBatch
+	pending	map[string]kvEntry	// Last write of each key, so the txn reads its own writes
+	reads		map[string]bool
+	done		bool
+}
+
+// Starts a transaction, it must be committed or rolled back to release its snapshot
+func (s *V6Store) Begin() (*Txn, error) {
+	snap, err := s.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &Txn{
+		store:		s,
+		snap:			snap,
+		writes:		NewWriteBatch(),
+		pending:	make(map[string]kvEntry),
+		reads:		make(map[string]bool),
+	}, nil
+}
+
+func (txn *Txn) Get(key string) (string, error) {
+	if txn.done {
+		return "", ErrClosed
+	}
+
+	if op, ok := txn.pending[key]; ok {
+		if op.Kind == KindDelete {
+			return "", fmt.Errorf("%w: %s", ErrNotFound, key)
+		}
+		return string(op.Value), nil
+	}
+
+	// Missing keys are tracked too, someone else creating them is a conflict
+	txn.reads[key] = true
+	return txn.snap.Get(key)
+}
+
+func (txn *Txn) Set(key, value string) error {
+	if txn.done {
+		return ErrClosed
+	}
+	txn.writes.Put(key, value)
+	txn.pending[key] = kvEntry{Value: []byte(value), Kind: KindPut}
+	return nil
+}
+
+func (txn *Txn) Delete(key string) error {
+	if txn.done {
+		return ErrClosed
+	}
+	txn.writes.Delete(key)
+	txn.pending[key] = kvEntry{Kind: KindDelete}
+	return nil
+}
+
+// Checks the read keys and applies the writes atomically
+// Read-only transactions always commit, their snapshot was consistent
+func (txn *Txn) Commit() error {
+	if txn.done {
+		return ErrClosed
+	}
+	defer txn.Rollback()
+
+	return txn.store.write(txn.writes, txn.validate)
+}
+
+// Drops the buffered writes and releases the snapshot. Safe to call after Commit
+func (txn *Txn) Rollback() {
+	if txn.done {
+		return
+	}
+	txn.done = true
+	txn.snap.Release()
+}
+
+// Runs under the store write lock, any version newer than the snapshot of a read key is a conflict
+func (txn *Txn) validate() error {
+	for key := range txn.reads {
+		latest, _, err := txn.store.latestEntry([]byte(key))
+		if err != nil {
+			return err
+		}
+		if latest.Seq > txn.snap.Seq() {
+			return fmt.Errorf("%w: %s was changed", ErrConflict, key)
+		}
+	}
+	return nil
+}
@@ -1,16 +1,27 @@
 package v6
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"os"
 	"path/filepath"
 	"sync"
 	"time"
 )
 
-const TOMBSTONE_VALUE = "null"
 const MAX_LEVEL = 2
 
+// Record kinds stored in the WAL, memtable and SSTables
+// Deletes are their own kind so "null" (or any other value) is just a value
+const (
+	KindPut			byte = 1
+	KindDelete	byte = 2
+
+	// Only in SSTables, the value is a pointer to the value log (see vlog.go)
+	KindValuePointer	byte = 3
+)
+
 type V6Store struct {
 	mu             sync.RWMutex
 	dataDir        string
@@ -19,48 +30,102 @@ type V6Store struct {
 	manager        *LSMManager
 	maxMemSize     int64
 	flushWg        sync.WaitGroup
+	opts           Options
+	closed         bool
+	seq            uint64					// Sequence number of the last write
+	recovery       WALReplayStats	// What replaying the WALs found when the store was opened
+	flushErr       error					// First failed memtable flush, writes and Close return it from then on
+	snapshots      *snapshotList
+	gcMu           sync.Mutex			// Held by ValueLogGC
 }
 
-func NewV6Store() *V6Store {
-	dataDir := filepath.Join("v6", "data")
-	if err := os.MkdirAll(dataDir, 0755); err != nil {
-    panic(fmt.Sprintf("failed to create data directory: %v", err))
+func NewV6Store() (*V6Store, error) {
+	return Open(filepath.Join("v6", "data"), DefaultOptions())
+}
+
+// Opens (or creates) a store in dir. Every store has its own directory so
+// several of them can be used in the same process
+func Open(dir string, opts Options) (*V6Store, error) {
+	opts = opts.withDefaults()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
 	}
 
-	manager := NewLSMManager(dataDir)
+	snapshots := newSnapshotList()
+	manager := NewLSMManager(dir, opts, snapshots)
 
 	// The manager already initializes the segments, indexes and bloom filters
 	manifest, err := manager.InitState()
 	if err != nil {
-		panic(fmt.Sprintf("failed to initialize db state: %v", err))
+		manager.Close()
+		return nil, fmt.Errorf("failed to initialize db state: %w", err)
 	}
 
+	s := &V6Store{
+		dataDir:        dir,
+		immutable:      nil,
+		manager:        manager,
+		maxMemSize:			opts.MemTableSize,
+		opts:						opts,
+		snapshots:			snapshots,
+	}
 
-	var walPath string
-	if manifest != nil && manifest.ActiveWAL != "" {
-		walPath = filepath.Join(dataDir, manifest.ActiveWAL)
-	} else {
-		walPath = filepath.Join(dataDir, "wal_0000.log")
-		if err := manager.UpdateActiveWAL("wal_0000.log"); err != nil {
-			panic(fmt.Sprintf("failed to update active WAL: %v", err))
+	// We crashed while flushing a memtable, its WAL is still there. Flush it again before
+	// opening the active WAL so the tiers stay ordered
+	if manifest.FlushingWAL != "" {
+		flushing, err := NewMemTable(filepath.Join(dir, manifest.FlushingWAL), opts.Durability, manager.MaxSeq())
+		if err != nil {
+			manager.Close()
+			return nil, fmt.Errorf("failed to recover flushing memtable: %w", err)
+		}
+		flushing.MakeReadOnly()
+		s.recovery = flushing.RecoveryStats()
+		s.immutable = flushing
+		if err := s.flushMemTable(flushing); err != nil {
+			flushing.Close()
+			manager.Close()
+			return nil, fmt.Errorf("failed to recover flushing memtable: %w", err)
 		}
 	}
+
+	walName := manifest.ActiveWAL
+	if walName == "" {
+		walName = manager.CreateWALName()
+	}
+	if err := manager.UpdateActiveWAL(walName); err != nil {
+		manager.Close()
+		return nil, fmt.Errorf("failed to update active WAL: %w", err)
+	}
+
 	// Create memtable, it automatically replays the previous WAL if exists
-	memtable, err := NewMemTable(walPath)
+	// The flushing memtable is in the SSTables by now, so they have the highest sequence number before the WAL
+	memtable, err := NewMemTable(filepath.Join(dir, walName), opts.Durability, manager.MaxSeq())
 	if err != nil {
-		panic(fmt.Sprintf("failed to create memtable: %v", err))
+		manager.Close()
+		return nil, fmt.Errorf("failed to create memtable: %w", err)
 	}
+	s.memtable = memtable
+	s.seq = memtable.LastSeq()
+	s.recovery.Records += memtable.RecoveryStats().Records
+	s.recovery.TruncatedBytes += memtable.RecoveryStats().TruncatedBytes
 
-	return &V6Store{
-		dataDir:        dataDir,
-		memtable:       memtable,
-		immutable:      nil,
-		manager:        manager,
-		maxMemSize:			300, // Small max size ~8 lines
-	}
+	return s, nil
+}
+
+// What the WAL replay recovered when the store was opened
+func (s *V6Store) RecoveryStats() WALReplayStats {
+	return s.recovery
 }
 
 func (s *V6Store) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+
 	// Wait for all flushes to complete
 	s.flushWg.Wait()
 
@@ -76,22 +141,78 @@ func (s *V6Store) Close() error {
 	}
 
 	s.manager.Close()
-	return nil
+	return s.flushErr
+}
+
+// Writes fail once the store is closed or a flush failed, expects s.mu to be locked
+// The immutable memtable of a failed flush stays in memory, its WAL is replayed on the next Open
+func (s *V6Store) writable() error {
+	if s.closed {
+		return ErrClosed
+	}
+	return s.flushErr
 }
 
 func (s *V6Store) Set(key, value string) error {
+	if err := s.manager.throttleWrite(); err != nil {
+		return err
+	}
+
 	s.mu.Lock()
+	if err := s.writable(); err != nil {
+		s.mu.Unlock()
+		return err
+	}
 
 	// Insert KV into memtable
-	if err := s.memtable.Insert([]byte(key), []byte(value)); err != nil {
+	commit, err := s.memtable.Insert([]byte(key), []byte(value), s.seq+1)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.seq++
+
+	return s.afterWrite(commit)
+}
+
+// Same as Set, the key reads as missing once ttl has passed. The expiry is stored as
+// a timestamp, so it survives restarts and merges drop the value after it
+func (s *V6Store) SetWithTTL(key, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("invalid ttl: %v", ttl)
+	}
+	if err := s.manager.throttleWrite(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if err := s.writable(); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+
+	expiresAt := time.Now().Add(ttl).UnixNano()
+	commit, err := s.memtable.InsertExpiring([]byte(key), []byte(value), s.seq+1, expiresAt)
+	if err != nil {
 		s.mu.Unlock()
 		return err
 	}
+	s.seq++
 
+	return s.afterWrite(commit)
+}
+
+// Waits for the WAL sync and checks if the memtable should be flushed after a write, expects s.mu to be locked
+func (s *V6Store) afterWrite(commit walCommit) error {
 	// After inserting, check if the memtable should be flushed
 	shouldFlush := s.memtable.ShouldFlush(s.maxMemSize)
 	s.mu.Unlock()
 
+	// Synced without holding the lock, so concurrent writers can share the fsync
+	if err := commit.Wait(); err != nil {
+		return fmt.Errorf("failed to sync WAL: %w", err)
+	}
+
 	// If the memtable should be flushed, rotate it
 	if shouldFlush {
 		return s.rotateMemTable()
@@ -101,71 +222,329 @@ func (s *V6Store) Set(key, value string) error {
 }
 
 func (s *V6Store) Get(key string) (string, error) {
+	return s.getAt(key, math.MaxUint64)
+}
+
+// Returns the newest version of the key with a sequence number <= seq
+func (s *V6Store) getAt(key string, seq uint64) (string, error) {
 	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return "", ErrClosed
+	}
+	if seq > s.seq {
+		seq = s.seq
+	}
 
 	// Check active memtable first
-	if val, err := s.memtable.Find([]byte(key)); err == nil {
+	if entry, found := s.memtable.LookupAt([]byte(key), seq); found {
 		s.mu.RUnlock()
-		if string(val) == TOMBSTONE_VALUE {
-			return "", fmt.Errorf("key not found")
-		}
-		return string(val), nil
+		return entryValue(key, entry)
 	}
 
 	// Check immutable memtable
 	if s.immutable != nil {
-		if val, err := s.immutable.Find([]byte(key)); err == nil {
+		if entry, found := s.immutable.LookupAt([]byte(key), seq); found {
 			s.mu.RUnlock()
-			if string(val) == TOMBSTONE_VALUE {
-				return "", fmt.Errorf("key not found")
-			}
-			return string(val), nil
+			return entryValue(key, entry)
 		}
 	}
 
+	// The SSTables are read without the lock, this keeps a merge from dropping the version we need
+	s.snapshots.acquire(seq)
+	defer s.snapshots.release(seq)
 	s.mu.RUnlock()
 
 	// Check LSM (already checks through range, bloom filter and entries)
-	if val, found := s.manager.Get([]byte(key)); found {
-		if string(val) == TOMBSTONE_VALUE {
-			return "", fmt.Errorf("key not found")
+	entry, found, err := s.manager.getEntry([]byte(key), seq)
+	if err != nil {
+		return "", err
+	}
+	if found {
+		// Still under the snapshot, the value log GC can't delete the value
+		if entry, err = s.manager.resolveValue(entry); err != nil {
+			return "", err
+		}
+		return entryValue(key, entry)
+	}
+
+	return "", fmt.Errorf("%w: %s", ErrNotFound, key)
+}
+
+// Tombstones and expired values both read as missing
+func entryValue(key string, entry kvEntry) (string, error) {
+	if entry.deleted(time.Now().UnixNano()) {
+		return "", fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	return string(entry.Value), nil
+}
+
+// Returns the live keys in [start, end) in order. An empty end means no upper bound
+// Merges the memtables and every SSTable, the newest version of a key wins and deleted keys are skipped
+// The scan reads from an implicit snapshot, writes made after it started are not seen
+func (s *V6Store) Scan(start, end string) (*ScanIterator, error) {
+	var endKey []byte
+	if end != "" {
+		endKey = []byte(end)
+	}
+	return s.scanAt([]byte(start), endKey, math.MaxUint64)
+}
+
+// Returns the live keys starting with prefix in order
+func (s *V6Store) ScanPrefix(prefix string) (*ScanIterator, error) {
+	return s.scanAt([]byte(prefix), prefixEnd([]byte(prefix)), math.MaxUint64)
+}
+
+func (s *V6Store) scanAt(start, end []byte, seq uint64) (*ScanIterator, error) {
+	// Memtables are copied so writes can keep going while we iterate
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return nil, ErrClosed
+	}
+	if seq > s.seq {
+		seq = s.seq
+	}
+	sources := []recordIterator{newSliceIterator(s.memtable.CollectRange(start, end, seq))}
+	if s.immutable != nil {
+		sources = append(sources, newSliceIterator(s.immutable.CollectRange(start, end, seq)))
+	}
+	s.snapshots.acquire(seq)
+	s.mu.RUnlock()
+
+	sstIters, err := s.manager.NewIterators(start, end)
+	if err != nil {
+		s.snapshots.release(seq)
+		return nil, err
+	}
+	sources = append(sources, sstIters...)
+
+	merge := newMergeIterator(sources, end, seq)
+	merge.resolve = s.manager.resolveValue
+	return &ScanIterator{
+		merge:		merge,
+		release:	func() { s.snapshots.release(seq) },
+	}, nil
+}
+
+// Merges every SSTable with keys in [start, end) down to the last tier, so deleted and
+// expired keys in the range stop taking space. An empty end means no upper bound.
+// The memtables are flushed first so the writes still in memory are compacted too
+func (s *V6Store) CompactRange(start, end string) error {
+	if err := s.flushMemTables(); err != nil {
+		return err
+	}
+
+	var endKey []byte
+	if end != "" {
+		endKey = []byte(end)
+	}
+	return s.manager.compactRange([]byte(start), endKey)
+}
+
+// Compacts the whole key space
+func (s *V6Store) CompactAll() error {
+	return s.CompactRange("", "")
+}
+
+// Hits and misses of the block cache, and how much of it is used
+func (s *V6Store) BlockCacheStats() BlockCacheStats {
+	return s.manager.blockCache.stats()
+}
+
+// Pending merges and how much L0 has been holding writes back
+func (s *V6Store) CompactionStats() CompactionStats {
+	return s.manager.compactionStats()
+}
+
+// Tables and data size per level, with what prefix compression saves
+func (s *V6Store) StorageStats() StorageStats {
+	return s.manager.storageStats()
+}
+
+// Storage, block cache, compaction and WAL recovery stats as text
+func (s *V6Store) Stats() string {
+	return formatStats(s.StorageStats(), s.BlockCacheStats(), s.CompactionStats(), s.RecoveryStats())
+}
+
+// Returns a point in time view of the store, it must be released once it's not needed
+func (s *V6Store) Snapshot() (*Snapshot, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return nil, ErrClosed
+	}
+	s.snapshots.acquire(s.seq)
+	return &Snapshot{store: s, seq: s.seq}, nil
+}
+
+// Applies every operation of the batch atomically, later operations on the same key win
+func (s *V6Store) Write(batch *WriteBatch) error {
+	return s.write(batch, nil)
+}
+
+// Applies the batch if check passes, check runs while holding the write lock
+// so nothing can be written between the check and the batch
+func (s *V6Store) write(batch *WriteBatch, check func() error) error {
+	if batch == nil || batch.Len() == 0 {
+		return nil
+	}
+	if err := s.manager.throttleWrite(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if err := s.writable(); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	if check != nil {
+		if err := check(); err != nil {
+			s.mu.Unlock()
+			return err
 		}
-		return string(val), nil
 	}
 
-	return "", fmt.Errorf("key not found")
+	commit, err := s.memtable.ApplyBatch(batch, s.seq+1)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.seq += uint64(batch.Len())
+
+	return s.afterWrite(commit)
+}
+
+// Newest version of the key (tombstones included), expects s.mu to be held
+// so nothing can be written until the caller is done with it
+func (s *V6Store) latestEntry(key []byte) (kvEntry, bool, error) {
+	if entry, found := s.memtable.latestEntry(key); found {
+		return entry, true, nil
+	}
+	if s.immutable != nil {
+		if entry, found := s.immutable.latestEntry(key); found {
+			return entry, true, nil
+		}
+	}
+	return s.manager.getEntry(key, math.MaxUint64)
+}
+
+// Returned by the write check when the condition doesn't hold, nothing gets written
+var errConditionFailed = errors.New("condition failed")
+
+// Puts the key unless the memtables or SSTables have a live version of it, deleted and expired keys count as absent
+func (s *V6Store) SetIfAbsent(key, value string) (bool, error) {
+	batch := NewWriteBatch()
+	batch.Put(key, value)
+	return s.writeIf(key, batch, func(current string, found bool) bool { return !found })
+}
+
+// Puts newValue if the newest version of the key holds oldValue, a missing or expired key never matches
+func (s *V6Store) CompareAndSwap(key, oldValue, newValue string) (bool, error) {
+	batch := NewWriteBatch()
+	batch.Put(key, newValue)
+	return s.writeIf(key, batch, func(current string, found bool) bool { return found && current == oldValue })
+}
+
+// Writes a tombstone if the newest version of the key still holds value
+func (s *V6Store) DeleteIfEquals(key, value string) (bool, error) {
+	batch := NewWriteBatch()
+	batch.Delete(key)
+	return s.writeIf(key, batch, func(current string, found bool) bool { return found && current == value })
+}
+
+// Writes the batch if cond holds for the newest value of the key, checked under the write lock
+func (s *V6Store) writeIf(key string, batch *WriteBatch, cond func(current string, found bool) bool) (bool, error) {
+	err := s.write(batch, func() error {
+		entry, found, err := s.latestEntry([]byte(key))
+		if err != nil {
+			return err
+		}
+		if entry, err = s.manager.resolveValue(entry); err != nil {
+			return err
+		}
+		if !cond(string(entry.Value), found && !entry.deleted(time.Now().UnixNano())) {
+			return errConditionFailed
+		}
+		return nil
+	})
+	if errors.Is(err, errConditionFailed) {
+		return false, nil
+	}
+	return err == nil, err
 }
 
 func (s *V6Store) Update(key, value string) error {
 	return s.Set(key, value)
 }
 
+// Writes a tombstone record, it hides older versions until a merge at the last tier drops it
 func (s *V6Store) Delete(key string) error {
-	return s.Set(key, TOMBSTONE_VALUE)
+	if err := s.manager.throttleWrite(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if err := s.writable(); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+
+	commit, err := s.memtable.Delete([]byte(key), s.seq+1)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.seq++
+
+	return s.afterWrite(commit)
 }
 
 func (s *V6Store) rotateMemTable() error {
+	toFlush, err := s.rotate(false)
+	if err != nil || toFlush == nil {
+		return err
+	}
+
+	go func() {
+		defer s.flushWg.Done()
+		s.flushMemTable(toFlush)
+	}()
+	return nil
+}
+
+// Moves the active memtable to immutable and returns it for the caller to flush, nil if it
+// doesn't need a flush (or is empty with force). flushWg is already counting the flush
+func (s *V6Store) rotate(force bool) (*MemTable, error) {
 	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	// Double check if the memtable should be flushed
-	if !s.memtable.ShouldFlush(s.maxMemSize){
-		s.mu.Unlock()
-		return nil
+	// Double check if the memtable should be flushed, again after waiting since the lock was released
+	shouldRotate := func() bool {
+		return s.writable() == nil && (force || s.memtable.ShouldFlush(s.maxMemSize)) && s.memtable.Count() > 0
+	}
+	if !shouldRotate() {
+		return nil, nil
 	}
 
-	for s.immutable != nil {
+	// A failed flush never clears the immutable, the write that got us here is in the WAL
+	// already and the next one returns the error
+	for s.immutable != nil && s.flushErr == nil {
 		s.mu.Unlock()
 		time.Sleep(10 * time.Millisecond) // Wait for the immutable to be flushed
 		s.mu.Lock()
 	}
+	if !shouldRotate() {
+		return nil, nil
+	}
 
 	// Create new memtable
-	walName := fmt.Sprintf("wal_%04d.log", s.manager.nextEntryID)
+	walName := s.manager.CreateWALName()
 	walPath := filepath.Join(s.dataDir, walName)
-	newMemtable, err := NewMemTable(walPath)
+	newMemtable, err := NewMemTable(walPath, s.opts.Durability, s.seq)
 	if err != nil {
-		s.mu.Unlock()
-		return fmt.Errorf("failed to rotate memtable: %v", err)
+		return nil, fmt.Errorf("failed to rotate memtable: %v", err)
 	}
 
 	// Move current memtable to immutable
@@ -173,34 +552,74 @@ func (s *V6Store) rotateMemTable() error {
 	s.immutable.MakeReadOnly()
 	s.memtable = newMemtable
 
-	if err := s.manager.UpdateActiveWAL(walName); err != nil {
-		s.mu.Unlock()
-		return fmt.Errorf("failed to update active WAL: %v", err)
+	// The manifest still points at the old WAL, keep writing to the old memtable
+	if err := s.manager.RotateWAL(walName); err != nil {
+		s.memtable = s.immutable
+		s.memtable.makeWritable()
+		s.immutable = nil
+		newMemtable.Close()
+		DeleteWAL(walPath)
+		return nil, fmt.Errorf("failed to update active WAL: %v", err)
 	}
 
-	toFlush := s.immutable
-	s.mu.Unlock()
-	
+	// Added under the lock, Close can't be waiting yet
 	s.flushWg.Add(1)
-	go func() {
+	return s.immutable, nil
+}
+
+// Flushes the active memtable and waits for it and for a flush that was already running
+func (s *V6Store) flushMemTables() error {
+	toFlush, err := s.rotate(true)
+	if err != nil {
+		return err
+	}
+	if toFlush != nil {
 		defer s.flushWg.Done()
-		s.flushMemTable(toFlush)
-	}()
-	return nil
+		return s.flushMemTable(toFlush)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for s.immutable != nil && s.writable() == nil {
+		s.mu.RUnlock()
+		time.Sleep(10 * time.Millisecond) // Wait for the immutable to be flushed
+		s.mu.RLock()
+	}
+	return s.writable()
 }
 
-func (s *V6Store) flushMemTable(mt *MemTable) {
+// Flushes the immutable memtable, a failure is kept in s.flushErr since nothing can be
+// rotated until the immutable memtable is gone
+func (s *V6Store) flushMemTable(mt *MemTable) error {
+	err := s.writeMemTable(mt)
+	if err != nil {
+		err = fmt.Errorf("failed to flush memtable: %w", err)
+		s.mu.Lock()
+		if s.flushErr == nil {
+			s.flushErr = err
+		}
+		s.mu.Unlock()
+	}
+	return err
+}
+
+func (s *V6Store) writeMemTable(mt *MemTable) error {
 	// Create paht
 	sstPath := s.manager.CreateSSTablePath()
 
-	// Flush memtable to SSTable
-	if err := mt.Flush(sstPath); err != nil {
-		return
+	// Flush memtable to SSTable, older versions only live snapshots can see are kept
+	// Big values go to the value log, it has to be on disk before the SSTable is committed
+	if err := mt.Flush(sstPath, s.opts, retention{snapshots: s.snapshots.sorted()}, s.manager.separateValue); err != nil {
+		return err
+	}
+	if err := s.manager.values.sync(); err != nil {
+		os.Remove(sstPath)
+		return err
 	}
 
 	// Add SSTable to manager
 	if err := s.manager.AddSSTable(sstPath); err != nil {
-		return
+		return err
 	}
 
 	// Delete WAL
@@ -218,4 +637,5 @@ func (s *V6Store) flushMemTable(mt *MemTable) {
 		s.immutable = nil
 	}
 	s.mu.Unlock()
+	return nil
 }
\ No newline at end of file
@@ -0,0 +1,438 @@
+package v6
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Key-value separation (WiscKey). Every merge rewrites the values of the SSTables it merges,
+// so big values are most of the write amplification. When a memtable is flushed, puts with
+// a value of at least ValueThreshold bytes append the value to a value log file and the
+// SSTable record becomes a KindValuePointer to it, merges only move the pointers around.
+// Reads resolve the pointer once they found the version they return.
+//
+// Value log files (vlog_XXXX.vlog) are append only and listed in the manifest. A new one is
+// started every ValueLogFileSize bytes, and the value log is synced before the SSTable
+// pointing to it is committed. Entries are framed like WAL entries:
+// [payloadLen uint32][crc32c uint32][keyLen uvarint][key][seq uvarint][value]
+//
+// Overwritten and deleted values stay in the files until ValueLogGC (vlog_gc.go) rewrites them
+const valueLogExt = ".vlog"
+
+// Where a value is in the value log, the offset and size are the whole frame
+type valuePointer struct {
+	file		int
+	offset	int64
+	size		int64
+}
+
+// SSTable value of a KindValuePointer record: [file uvarint][offset uvarint][size uvarint]
+func (p valuePointer) encode() []byte {
+	data := binary.AppendUvarint(nil, uint64(p.file))
+	data = binary.AppendUvarint(data, uint64(p.offset))
+	return binary.AppendUvarint(data, uint64(p.size))
+}
+
+func decodeValuePointer(data []byte) (valuePointer, error) {
+	var fields [3]uint64
+	for i := range fields {
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			return valuePointer{}, fmt.Errorf("invalid value pointer")
+		}
+		fields[i] = v
+		data = data[n:]
+	}
+	return valuePointer{file: int(fields[0]), offset: int64(fields[1]), size: int64(fields[2])}, nil
+}
+
+// One value read back from a value log file
+type valueLogEntry struct {
+	key		[]byte
+	seq		uint64
+	value	[]byte
+	ptr		valuePointer
+}
+
+type valueLog struct {
+	dir					string
+	threshold		int		// Values this big or bigger are separated, negative never
+	maxFileSize	int64
+
+	mu					sync.RWMutex
+	files				map[int]*os.File	// Every file in the manifest, opened for reading
+	active			*os.File					// File being appended to, nil until the first value after opening
+	activeID		int
+	activeSize	int64
+	writer			*bufio.Writer
+}
+
+func newValueLog(dir string, opts Options) *valueLog {
+	return &valueLog{
+		dir:					dir,
+		threshold:		opts.ValueThreshold,
+		maxFileSize:	opts.ValueLogFileSize,
+		files:				make(map[int]*os.File),
+	}
+}
+
+func valueLogName(id int) string {
+	return fmt.Sprintf("vlog_%04d%s", id, valueLogExt)
+}
+
+// Opens the files of the manifest. Nothing is appended to them, the first value after
+// opening starts a new file so a torn tail from a crash is never written after
+func (v *valueLog) open(names []string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for _, name := range names {
+		var id int
+		if _, err := fmt.Sscanf(name, "vlog_%04d.vlog", &id); err != nil {
+			return &CorruptionError{Path: filepath.Join(v.dir, name), Reason: "invalid value log name"}
+		}
+		file, err := os.Open(filepath.Join(v.dir, name))
+		if err != nil {
+			return fmt.Errorf("failed to open value log %s: %w", name, err)
+		}
+		v.files[id] = file
+	}
+	return nil
+}
+
+// Names of the value log files, for the manifest
+func (v *valueLog) names() []string {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	var names []string
+	for _, id := range v.ids() {
+		names = append(names, valueLogName(id))
+	}
+	return names
+}
+
+// Expects v.mu held
+func (v *valueLog) ids() []int {
+	ids := make([]int, 0, len(v.files))
+	for id := range v.files {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// Files nothing is appended to anymore, oldest first. Only these are garbage collected
+func (v *valueLog) sealed() []int {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	var sealed []int
+	for _, id := range v.ids() {
+		if v.active == nil || id != v.activeID {
+			sealed = append(sealed, id)
+		}
+	}
+	return sealed
+}
+
+func (v *valueLog) separates(entry kvEntry) bool {
+	return v.threshold >= 0 && entry.Kind == KindPut && len(entry.Value) >= v.threshold
+}
+
+// Whether the next value needs a new file. Values are only appended by the flush of the
+// immutable memtable, there's one at a time
+func (v *valueLog) full() bool {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	return v.active == nil || v.activeSize >= v.maxFileSize
+}
+
+// Seals the active file and starts appending to a new one
+func (v *valueLog) startFile(id int) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if err := v.sealActive(); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filepath.Join(v.dir, valueLogName(id)), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create value log: %w", err)
+	}
+	v.files[id] = file
+	v.active, v.activeID, v.activeSize = file, id, 0
+	v.writer = bufio.NewWriter(file)
+	return nil
+}
+
+// Appends the value to the active file
+func (v *valueLog) append(entry kvEntry) (valuePointer, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.active == nil {
+		return valuePointer{}, fmt.Errorf("no active value log")
+	}
+	payload := binary.AppendUvarint(nil, uint64(len(entry.Key)))
+	payload = append(payload, entry.Key...)
+	payload = binary.AppendUvarint(payload, entry.Seq)
+	payload = append(payload, entry.Value...)
+	frame := frameWALEntry(payload)
+	if _, err := v.writer.Write(frame); err != nil {
+		return valuePointer{}, fmt.Errorf("failed to append to value log: %w", err)
+	}
+
+	ptr := valuePointer{file: v.activeID, offset: v.activeSize, size: int64(len(frame))}
+	v.activeSize += int64(len(frame))
+	return ptr, nil
+}
+
+// Flushes and syncs the active file, the pointers handed out so far can be committed
+func (v *valueLog) sync() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.active == nil {
+		return nil
+	}
+	if err := v.writer.Flush(); err != nil {
+		return fmt.Errorf("failed to flush value log: %w", err)
+	}
+	if err := v.active.Sync(); err != nil {
+		return fmt.Errorf("failed to sync value log: %w", err)
+	}
+	return nil
+}
+
+// Syncs the full active file and stops appending to it, it stays open for reads. Expects v.mu held
+func (v *valueLog) sealActive() error {
+	if v.active == nil {
+		return nil
+	}
+	if err := v.writer.Flush(); err != nil {
+		return fmt.Errorf("failed to flush value log: %w", err)
+	}
+	if err := v.active.Sync(); err != nil {
+		return fmt.Errorf("failed to sync value log: %w", err)
+	}
+	v.active, v.writer = nil, nil
+	return nil
+}
+
+// Reads the value the pointer of key points to
+func (v *valueLog) read(key []byte, ptr valuePointer) ([]byte, error) {
+	v.mu.RLock()
+	file, ok := v.files[ptr.file]
+	v.mu.RUnlock()
+	path := filepath.Join(v.dir, valueLogName(ptr.file))
+	if !ok {
+		return nil, &CorruptionError{Path: path, Offset: ptr.offset, Reason: "pointer to a missing value log"}
+	}
+
+	frame := make([]byte, ptr.size)
+	if _, err := file.ReadAt(frame, ptr.offset); err != nil {
+		return nil, &CorruptionError{Path: path, Offset: ptr.offset, Reason: fmt.Sprintf("failed to read value: %v", err)}
+	}
+	entry, err := parseValueLogFrame(frame)
+	if err != nil {
+		return nil, &CorruptionError{Path: path, Offset: ptr.offset, Reason: err.Error()}
+	}
+	if !bytes.Equal(entry.key, key) {
+		return nil, &CorruptionError{Path: path, Offset: ptr.offset, Reason: fmt.Sprintf("value belongs to key %q, not %q", entry.key, key)}
+	}
+	return entry.value, nil
+}
+
+func parseValueLogFrame(frame []byte) (valueLogEntry, error) {
+	if len(frame) < walFrameHeaderSize {
+		return valueLogEntry{}, fmt.Errorf("value frame is too short")
+	}
+	header, payload := frame[:walFrameHeaderSize], frame[walFrameHeaderSize:]
+	if int(binary.BigEndian.Uint32(header[0:4])) != len(payload) {
+		return valueLogEntry{}, fmt.Errorf("value frame length mismatch")
+	}
+	if walChecksum(header[0:4], payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return valueLogEntry{}, fmt.Errorf("value checksum mismatch")
+	}
+
+	keyLen, n := binary.Uvarint(payload)
+	if n <= 0 || keyLen > uint64(len(payload)-n) {
+		return valueLogEntry{}, fmt.Errorf("invalid key length")
+	}
+	key := payload[n : n+int(keyLen)]
+	payload = payload[n+int(keyLen):]
+	seq, n := binary.Uvarint(payload)
+	if n <= 0 {
+		return valueLogEntry{}, fmt.Errorf("invalid sequence number")
+	}
+	return valueLogEntry{key: key, seq: seq, value: payload[n:]}, nil
+}
+
+// Every entry of a sealed file and the file size. A torn tail (we crashed while flushing a
+// memtable, nothing points to it) ends the entries
+func (v *valueLog) entries(id int) ([]valueLogEntry, int64, error) {
+	data, err := os.ReadFile(filepath.Join(v.dir, valueLogName(id)))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read value log: %w", err)
+	}
+
+	var entries []valueLogEntry
+	offset := 0
+	for len(data)-offset >= walFrameHeaderSize {
+		end := offset + walFrameHeaderSize + int(binary.BigEndian.Uint32(data[offset:offset+4]))
+		if end > len(data) {
+			break
+		}
+		entry, err := parseValueLogFrame(data[offset:end])
+		if err != nil {
+			break
+		}
+		entry.ptr = valuePointer{file: id, offset: int64(offset), size: int64(end - offset)}
+		entries = append(entries, entry)
+		offset = end
+	}
+	return entries, int64(len(data)), nil
+}
+
+// Takes a file out of the value log, the caller closes it. nil if it isn't there
+func (v *valueLog) detach(id int) *os.File {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	file := v.files[id]
+	delete(v.files, id)
+	if v.active != nil && id == v.activeID {
+		v.active, v.writer = nil, nil
+	}
+	return file
+}
+
+// Puts back a file detach took out
+func (v *valueLog) attach(id int, file *os.File) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.files[id] = file
+}
+
+// Files and bytes on disk
+func (v *valueLog) size() (int, int64) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	var total int64
+	for id, file := range v.files {
+		if id == v.activeID && v.active != nil {
+			total += v.activeSize
+			continue
+		}
+		if stat, err := file.Stat(); err == nil {
+			total += stat.Size()
+		}
+	}
+	return len(v.files), total
+}
+
+func (v *valueLog) close() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	err := v.sealActive()
+	for _, file := range v.files {
+		file.Close()
+	}
+	v.files = make(map[int]*os.File)
+	return err
+}
+
+// Moves the value of a flushed put to the value log if it's big enough.
+// Lock order is lsm.mu then the value log's, the manifest lists its files
+func (lsm *LSMManager) separateValue(entry kvEntry) (kvEntry, error) {
+	if !lsm.values.separates(entry) {
+		return entry, nil
+	}
+	if lsm.values.full() {
+		if err := lsm.createValueLog(); err != nil {
+			return kvEntry{}, err
+		}
+	}
+	ptr, err := lsm.values.append(entry)
+	if err != nil {
+		return kvEntry{}, err
+	}
+	entry.Kind = KindValuePointer
+	entry.Value = ptr.encode()
+	return entry, nil
+}
+
+// Starts a new value log file and adds it to the manifest before anything points to it.
+// It's in the value log first so a checkpoint of the manifest has it too
+func (lsm *LSMManager) createValueLog() error {
+	lsm.mu.Lock()
+	id := lsm.nextEntryID
+	lsm.nextEntryID++
+	lsm.mu.Unlock()
+
+	if err := lsm.values.startFile(id); err != nil {
+		return err
+	}
+
+	lsm.mu.Lock()
+	err := lsm.logEdit(versionEdit{AddedValueLogs: []string{valueLogName(id)}})
+	lsm.mu.Unlock()
+	if err != nil {
+		if file := lsm.values.detach(id); file != nil {
+			file.Close()
+			os.Remove(file.Name())
+		}
+		return fmt.Errorf("failed to add value log to manifest: %w", err)
+	}
+	return nil
+}
+
+// Takes a value log file out of the manifest and deletes it
+func (lsm *LSMManager) removeValueLog(id int) error {
+	file := lsm.values.detach(id)
+	if file == nil {
+		return nil
+	}
+
+	lsm.mu.Lock()
+	err := lsm.logEdit(versionEdit{RemovedValueLogs: []string{valueLogName(id)}})
+	lsm.mu.Unlock()
+	if err != nil {
+		lsm.values.attach(id, file)
+		return fmt.Errorf("failed to remove value log from manifest: %w", err)
+	}
+
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// Replaces a value pointer with the value. Tombstones and expired values are returned as
+// they are, nothing reads their value
+func (lsm *LSMManager) resolveValue(entry kvEntry) (kvEntry, error) {
+	if entry.Kind != KindValuePointer || entry.expired(time.Now().UnixNano()) {
+		return entry, nil
+	}
+	ptr, err := decodeValuePointer(entry.Value)
+	if err != nil {
+		return kvEntry{}, err
+	}
+	value, err := lsm.values.read(entry.Key, ptr)
+	if err != nil {
+		return kvEntry{}, err
+	}
+	entry.Kind = KindPut
+	entry.Value = value
+	return entry, nil
+}
@@ -0,0 +1,162 @@
+package v6
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Value log garbage collection. The LSM is the source of truth: a value in a value log file
+// is live if the newest version of its key is a pointer to it. Older versions only a
+// snapshot could still read count as dead, a file isn't deleted while a snapshot older than
+// the GC is open.
+//
+// The live values of a file with enough dead bytes are written again like any other put,
+// checked under the write lock so a newer write to the key isn't overwritten. They get a new
+// sequence number (a transaction that read the key before conflicts) and go to a new value
+// log file when their memtable is flushed. Once the memtables are flushed nothing newer than
+// the snapshots points to the old file, it's taken out of the manifest and deleted
+
+type ValueLogGCStats struct {
+	FilesRewritten	int			// Files whose live values were moved
+	ValuesMoved			int
+	FilesRemoved		int
+	BytesReclaimed	int64		// Size of the removed files
+	FilesKept				int			// Rewritten but still readable by an open snapshot, removed by the next GC
+}
+
+// Rewrites the sealed value log files where at least discardRatio (0-1] of the bytes are dead
+func (s *V6Store) ValueLogGC(discardRatio float64) (ValueLogGCStats, error) {
+	var stats ValueLogGCStats
+	if discardRatio <= 0 || discardRatio > 1 {
+		return stats, fmt.Errorf("invalid discard ratio: %v", discardRatio)
+	}
+
+	// One GC at a time, two would move the same values
+	s.gcMu.Lock()
+	defer s.gcMu.Unlock()
+
+	var rewritten []int
+	var sizes []int64
+	for _, id := range s.manager.values.sealed() {
+		entries, size, err := s.manager.values.entries(id)
+		if err != nil {
+			return stats, err
+		}
+		live, liveBytes, err := s.liveValues(entries)
+		if err != nil {
+			return stats, err
+		}
+		if size > 0 && float64(size-liveBytes)/float64(size) < discardRatio {
+			continue
+		}
+
+		for _, entry := range live {
+			moved, err := s.moveValue(entry)
+			if err != nil {
+				return stats, fmt.Errorf("failed to move value of %q: %w", entry.key, err)
+			}
+			if moved {
+				stats.ValuesMoved++
+			}
+		}
+		stats.FilesRewritten++
+		rewritten = append(rewritten, id)
+		sizes = append(sizes, size)
+	}
+	if len(rewritten) == 0 {
+		return stats, nil
+	}
+
+	// The moved values have to be in the SSTables (and the new value log) before the old
+	// file can go, the WAL might not be synced
+	if stats.ValuesMoved > 0 {
+		if err := s.flushMemTables(); err != nil {
+			return stats, err
+		}
+	}
+
+	// Under the write lock nothing can read through a pointer without holding a snapshot,
+	// and new snapshots only see the moved values
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return stats, ErrClosed
+	}
+	if snapshots := s.snapshots.sorted(); len(snapshots) > 0 && snapshots[0] < s.seq {
+		stats.FilesKept = len(rewritten)
+		return stats, nil
+	}
+	for i, id := range rewritten {
+		if err := s.manager.removeValueLog(id); err != nil {
+			return stats, err
+		}
+		stats.FilesRemoved++
+		stats.BytesReclaimed += sizes[i]
+	}
+	return stats, nil
+}
+
+// Entries the newest version of their key points to, and their bytes
+func (s *V6Store) liveValues(entries []valueLogEntry) ([]valueLogEntry, int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return nil, 0, ErrClosed
+	}
+
+	var live []valueLogEntry
+	var liveBytes int64
+	now := time.Now().UnixNano()
+	for _, entry := range entries {
+		ok, err := s.pointsTo(entry, now)
+		if err != nil {
+			return nil, 0, err
+		}
+		if ok {
+			live = append(live, entry)
+			liveBytes += entry.ptr.size
+		}
+	}
+	return live, liveBytes, nil
+}
+
+// Whether the newest version of the entry's key is a pointer to it. Expired values are dead
+// too, nothing reads them anymore. Expects s.mu held
+func (s *V6Store) pointsTo(entry valueLogEntry, now int64) (bool, error) {
+	latest, found, err := s.latestEntry(entry.key)
+	if err != nil || !found || latest.Kind != KindValuePointer || latest.expired(now) {
+		return false, err
+	}
+	ptr, err := decodeValuePointer(latest.Value)
+	if err != nil {
+		return false, err
+	}
+	return ptr == entry.ptr, nil
+}
+
+// Writes the value again unless the key changed since it was found live
+func (s *V6Store) moveValue(entry valueLogEntry) (bool, error) {
+	batch := NewWriteBatch()
+	batch.ops = append(batch.ops, kvEntry{Key: entry.key, Value: entry.value, Kind: KindPut})
+	err := s.write(batch, func() error {
+		latest, _, err := s.latestEntry(entry.key)
+		if err != nil {
+			return err
+		}
+		ok, err := s.pointsTo(entry, time.Now().UnixNano())
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errConditionFailed
+		}
+		// Keeps the TTL, the value log doesn't have it
+		batch.ops[0].ExpiresAt = latest.ExpiresAt
+		return nil
+	})
+	if errors.Is(err, errConditionFailed) {
+		return false, nil
+	}
+	return err == nil, err
+}
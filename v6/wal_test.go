@@ -0,0 +1,123 @@
+package v6
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Writes count puts to a new WAL and returns its path
+func writeTestWAL(t *testing.T, count int) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "wal_0001.log")
+	wal, err := NewWAL(path, NoSync)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= count; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if err := wal.WritePut([]byte(key), []byte("value"), uint64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stat.Size()
+}
+
+func TestReplayWALTruncatesTornTail(t *testing.T) {
+	path := writeTestWAL(t, 5)
+	size := fileSize(t, path)
+
+	// Cut the last entry in half, like a crash in the middle of the write
+	if err := os.Truncate(path, size-3); err != nil {
+		t.Fatal(err)
+	}
+
+	mt, err := NewMemTable(path, NoSync, 0)
+	if err != nil {
+		t.Fatalf("expected the torn tail to be dropped, got %v", err)
+	}
+	defer mt.Close()
+
+	stats := mt.RecoveryStats()
+	if stats.Records != 4 {
+		t.Errorf("expected 4 recovered entries, got %d", stats.Records)
+	}
+	if stats.TruncatedBytes == 0 {
+		t.Errorf("expected the torn entry to be truncated")
+	}
+	for i := 1; i <= 4; i++ {
+		if _, err := mt.Find([]byte(fmt.Sprintf("key%d", i))); err != nil {
+			t.Errorf("key%d: %v", i, err)
+		}
+	}
+	if _, err := mt.Find([]byte("key5")); err == nil {
+		t.Errorf("key5 was torn, it shouldn't be replayed")
+	}
+}
+
+func TestReplayWALCorruptLengthInTheMiddle(t *testing.T) {
+	path := writeTestWAL(t, 5)
+	size := fileSize(t, path)
+
+	// Make the first entry claim more bytes than the file has, valid entries still follow it
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.BigEndian.PutUint32(data[len(walMagic):], 1<<20)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewMemTable(path, NoSync, 0)
+	if !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("expected ErrCorrupt, got %v", err)
+	}
+	var corruption *CorruptionError
+	if !errors.As(err, &corruption) || corruption.Offset != int64(len(walMagic)) {
+		t.Errorf("expected a CorruptionError at the first entry, got %v", err)
+	}
+	if got := fileSize(t, path); got != size {
+		t.Errorf("the WAL must not be truncated, size went from %d to %d", size, got)
+	}
+}
+
+func TestReplayLegacyWALSkipsBlankLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal_0001.log")
+	data := "PUT key1:value\n\nDEL key2\n\n\nPUT key3:value\n"
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mt, err := NewMemTable(path, NoSync, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mt.Close()
+
+	if stats := mt.RecoveryStats(); stats.Records != 3 {
+		t.Errorf("expected 3 recovered entries, got %d", stats.Records)
+	}
+	for _, key := range []string{"key1", "key3"} {
+		if _, err := mt.Find([]byte(key)); err != nil {
+			t.Errorf("%s: %v", key, err)
+		}
+	}
+}
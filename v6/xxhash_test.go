@@ -0,0 +1,25 @@
+package v6
+
+import "testing"
+
+// Published XXH64 values (seed 0). They cover the empty input, the 1 and 4 byte tails,
+// the 8 byte lanes and the 32 byte stripes of the main loop
+func TestXXHash64KnownAnswers(t *testing.T) {
+	tests := []struct {
+		input	string
+		want	uint64
+	}{
+		{"", 0xef46db3751d8e999},
+		{"a", 0xd24ec4f1a98c6e5b},
+		{"abc", 0x44bc2cf5ad770999},
+		{"message digest", 0x066ed728fceeb3be},
+		{"abcdefghijklmnopqrstuvwxyz", 0xcfe1f278fa89835c},
+		{"The quick brown fox jumps over the lazy dog", 0x0b242d361fda71bc},
+		{"12345678901234567890123456789012345678901234567890123456789012345678901234567890", 0xe04a477f19ee145d},
+	}
+	for _, tt := range tests {
+		if got := xxhash64([]byte(tt.input)); got != tt.want {
+			t.Errorf("xxhash64(%q) = %#016x, want %#016x", tt.input, got, tt.want)
+		}
+	}
+}